@@ -0,0 +1,157 @@
+package main
+
+// Read only JSON API under /tang/api/
+//
+//	GET /tang/api/repositories            repositories tang has built
+//	GET /tang/api/builds                  builds, most recent first, filtered by
+//	                                      ?repo=org/name&ref=&state=&pusher=&limit=
+//	GET /tang/api/builds/<id>             a single build
+//	GET /tang/api/builds/<id>/log         the build's log, Range requests work
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Number of builds returned by /tang/api/builds unless ?limit= is given
+const apiDefaultLimit = 100
+
+// HTTP handler for /tang/api/
+func handleAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		apiError(w, http.StatusMethodNotAllowed, "Only GET is supported")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/tang/api/"), "/"), "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "repositories":
+		apiRepositories(w, r)
+
+	case len(parts) == 1 && parts[0] == "builds":
+		apiBuilds(w, r)
+
+	case len(parts) == 2 && parts[0] == "builds":
+		record, ok := buildStore.Get(parts[1])
+		if !ok {
+			apiError(w, http.StatusNotFound, "No such build")
+			return
+		}
+		writeJSON(w, http.StatusOK, record)
+
+	case len(parts) == 3 && parts[0] == "builds" && parts[2] == "log":
+		apiBuildLog(w, r, parts[1])
+
+	default:
+		apiError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+func apiRepositories(w http.ResponseWriter, r *http.Request) {
+	seen := map[string]bool{}
+	repositories := []Repository{}
+	for _, record := range buildStore.List() {
+		if seen[record.RepoName()] {
+			continue
+		}
+		seen[record.RepoName()] = true
+		repositories = append(repositories, record.Repository)
+	}
+	sort.Sort(byOrganizationAndName(repositories))
+	writeJSON(w, http.StatusOK, repositories)
+}
+
+type byOrganizationAndName []Repository
+
+func (r byOrganizationAndName) Len() int      { return len(r) }
+func (r byOrganizationAndName) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r byOrganizationAndName) Less(i, j int) bool {
+	if r[i].Organization != r[j].Organization {
+		return r[i].Organization < r[j].Organization
+	}
+	return r[i].Name < r[j].Name
+}
+
+func apiBuilds(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	repo, ref := query.Get("repo"), query.Get("ref")
+	state, pusher := query.Get("state"), query.Get("pusher")
+
+	limit := apiDefaultLimit
+	if l := query.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 {
+			apiError(w, http.StatusBadRequest, "limit should be a positive integer")
+			return
+		}
+	}
+
+	builds := []BuildRecord{}
+	for _, record := range buildStore.List() {
+		switch {
+		case repo != "" && record.RepoName() != repo:
+		case ref != "" && record.Ref != ref && shortRef(record.Ref) != ref:
+		case state != "" && record.State != state:
+		case pusher != "" && record.Pusher.Name != pusher:
+		default:
+			builds = append(builds, record)
+		}
+		if len(builds) == limit {
+			break
+		}
+	}
+	writeJSON(w, http.StatusOK, builds)
+}
+
+func apiBuildLog(w http.ResponseWriter, r *http.Request, id string) {
+	record, ok := buildStore.Get(id)
+	if !ok {
+		apiError(w, http.StatusNotFound, "No such build")
+		return
+	}
+	if record.LogPath == "" {
+		apiError(w, http.StatusNotFound, "Build has no log yet")
+		return
+	}
+
+	fd, err := os.Open(record.LogPath)
+	if err != nil {
+		apiError(w, http.StatusNotFound, "Log is missing")
+		return
+	}
+	defer fd.Close()
+
+	info, err := fd.Stat()
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	// Handles Range requests, so that a growing log can be fetched
+	// incrementally.
+	http.ServeContent(w, r, "log.txt", info.ModTime(), fd)
+}
+
+func writeJSON(w http.ResponseWriter, code int, value interface{}) {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		log.Println("writeJSON:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(append(data, '\n'))
+}
+
+func apiError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]string{"error": message})
+}
@@ -0,0 +1,176 @@
+package main
+
+// Webhooks from bitbucket cloud, and build statuses sent back to it
+// https://support.atlassian.com/bitbucket-cloud/docs/event-payloads/
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+type bitbucketProvider struct{}
+
+type bitbucketUser struct {
+	Nickname string `json:"nickname"`
+}
+
+type bitbucketRepository struct {
+	FullName string `json:"full_name"` // e.g "workspace/repo-slug"
+	Links    struct {
+		Html struct {
+			Href string `json:"href"`
+		} `json:"html"`
+	} `json:"links"`
+}
+
+func (r bitbucketRepository) Repository() Repository {
+	organization, name := splitRepoName(r.FullName)
+	url := r.Links.Html.Href
+	if url == "" {
+		url = "https://bitbucket.org/" + r.FullName
+	}
+	return Repository{Name: name, Url: url + ".git", Organization: organization,
+		Provider: "bitbucket"}
+}
+
+// A branch or tag, before or after a push
+type bitbucketRef struct {
+	Type   string `json:"type"` // "branch", "tag" or "annotated_tag"
+	Name   string `json:"name"`
+	Target struct {
+		Hash string `json:"hash"`
+	} `json:"target"`
+}
+
+func (r *bitbucketRef) Ref() string {
+	if r.Type == "branch" {
+		return "refs/heads/" + r.Name
+	}
+	return "refs/tags/" + r.Name
+}
+
+// "repo:push", which can change several refs at once
+type bitbucketPushEvent struct {
+	Actor      bitbucketUser       `json:"actor"`
+	Repository bitbucketRepository `json:"repository"`
+	Push       struct {
+		Changes []struct {
+			New *bitbucketRef `json:"new"` // nil when deleted
+			Old *bitbucketRef `json:"old"` // nil when created
+		} `json:"changes"`
+	} `json:"push"`
+	NonGithub NonGithub `json:"nongithub"`
+}
+
+func (bitbucketProvider) Name() string { return "bitbucket" }
+
+// Bitbucket is only listened to once tang can check its hooks, and send
+// statuses back.
+func (p bitbucketProvider) configured() bool {
+	return bitbucket_webhook_secret != "" && bitbucket_user != "" && bitbucket_password != ""
+}
+
+func (p bitbucketProvider) Detect(header http.Header) bool {
+	return p.configured() && header.Get("X-Event-Key") != ""
+}
+
+func (bitbucketProvider) EventType(header http.Header) string {
+	return header.Get("X-Event-Key")
+}
+
+// Bitbucket signs the payload like github does, but only with sha256, in
+// X-Hub-Signature.
+func (p bitbucketProvider) Verify(header http.Header, body []byte) error {
+	if !p.configured() {
+		return ErrProviderNotConfigured
+	}
+	signature := header.Get("X-Hub-Signature")
+	if signature == "" {
+		return ErrMissingToken
+	}
+	if !strings.HasPrefix(signature, "sha256=") {
+		return ErrBadSignature
+	}
+	return checkHMAC(sha256.New, bitbucket_webhook_secret, body,
+		strings.TrimPrefix(signature, "sha256="))
+}
+
+func (bitbucketProvider) Handle(eventType string, document []byte) (err error) {
+	jsonLog.Println("Incoming bitbucket request:", string(document))
+
+	switch eventType {
+	case "repo:push":
+		var event bitbucketPushEvent
+		err = json.Unmarshal(document, &event)
+		if err != nil {
+			return
+		}
+		for _, change := range event.Push.Changes {
+			if change.New == nil {
+				// The branch or tag was deleted
+				continue
+			}
+			before := zeroSha
+			if change.Old != nil {
+				before = change.Old.Target.Hash
+			}
+			// The payload doesn't say which files changed
+			e := eventPush(PushEvent{
+				Ref:        change.New.Ref(),
+				Repository: event.Repository.Repository(),
+				Before:     before,
+				After:      change.New.Target.Hash,
+				Pusher:     Pusher{Name: event.Actor.Nickname},
+				NonGithub:  event.NonGithub,
+			})
+			if e != nil && err == nil {
+				err = e
+			}
+		}
+
+	case "pullrequest:created", "pullrequest:updated":
+		// Bitbucket has no refs for pull requests, so those from forks
+		// can't be fetched, and the others were built when their branch
+		// was pushed.
+		log.Println("Ignoring bitbucket pull request event:", eventType)
+
+	default:
+		log.Println("Unhandled bitbucket event:", eventType)
+	}
+	return
+}
+
+// https://developer.atlassian.com/cloud/bitbucket/rest/api-group-commit-statuses/
+func (bitbucketProvider) SendStatus(repo, sha string, s GithubStatus) bool {
+	if bitbucket_user == "" {
+		log.Printf("BITBUCKET_USER not specified, not sending status of %v %v", repo, sha)
+		return true
+	}
+	state := "INPROGRESS"
+	switch s.State {
+	case "success":
+		state = "SUCCESSFUL"
+	case "failure", "error":
+		state = "FAILED"
+	}
+	status := map[string]string{
+		"key":         s.Context,
+		"name":        s.Context,
+		"state":       state,
+		"url":         s.TargetUrl,
+		"description": s.Description,
+	}
+	endpoint := providerEndpoint(*bitbucketAPI, "repositories", repo, "commit", sha,
+		"statuses", "build")
+	return postStatus("bitbucket", repo, sha, endpoint, status, func(req *http.Request) {
+		req.SetBasicAuth(bitbucket_user, bitbucket_password)
+	})
+}
+
+// An app password, which needs the username it belongs to.
+func (bitbucketProvider) Credentials(repo string) (username, password string, err error) {
+	return bitbucket_user, bitbucket_password, nil
+}
@@ -0,0 +1,506 @@
+package main
+
+// Code responsible for building one commit of a repository
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrSuperseded = errors.New("Superseded by a newer build")
+
+// The states of a build. The finished states other than skipped,
+// superseded and interrupted are the same as the github status sent.
+const (
+	StateQueued      = "queued"
+	StateRunning     = "running"
+	StateSuccess     = "success"
+	StateFailure     = "failure"
+	StateError       = "error"
+	StateSkipped     = "skipped"
+	StateSuperseded  = "superseded"
+	StateInterrupted = "interrupted"
+)
+
+// The part of a build which is kept in the BuildStore.
+type BuildRecord struct {
+	ID         string     `json:"id"` // unique, sorts in the order builds were queued
+	Repository Repository `json:"repository"`
+	Ref        string     `json:"ref"`      // e.g, refs/heads/master or refs/pull/1/head
+	Before     string     `json:"before"`   // what Ref pointed to before a push, if known
+	Sha        string     `json:"sha"`      // the commit which statuses are reported against
+	Checkout   string     `json:"checkout"` // what is checked out and run, usually Sha
+	Pusher     Pusher     `json:"pusher"`
+	Event      string     `json:"event"` // the github event which triggered the build
+
+	// Non-zero if the build is for a pull request
+	PullRequest int `json:"pull_request,omitempty"`
+
+	// The name of the release, if the build is for one
+	Release string `json:"release,omitempty"`
+
+	State    string    `json:"state"`
+	Queued   time.Time `json:"queued"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+
+	// The exit status of tang.hook, nil if it never finished running
+	ExitStatus *int   `json:"exit_status,omitempty"`
+	Error      string `json:"error,omitempty"`
+
+	// Relative to the tang URL, e.g logs/scraperwiki/tang/<sha>/<id>/log.txt
+	LogPath string `json:"log_path,omitempty"`
+
+	// Every status sent to github, in order
+	Statuses []GithubStatus `json:"statuses,omitempty"`
+}
+
+// A Build is a single run of tang.hook against one commit of a repository.
+type Build struct {
+	BuildRecord
+
+	NonGithub NonGithub
+
+	// Closed when the build has finished, after which err is valid.
+	done chan struct{}
+	err  error
+
+	// Closed to stop the build early, see Cancel()
+	cancel       chan struct{}
+	cancelOnce   sync.Once
+	supersededBy string
+
+	// The repository's tang.yml, nil if it hasn't got one
+	repoFile *RepoFile
+
+	// The files changed by the push, from its payload, nil if unknown.
+	changedFiles []string
+
+	// The build's github check run, nil unless -checks is given
+	check *checkRun
+
+	// The queue the build was submitted to, and its concurrency group there
+	// once it is known, see BuildQueue.joinGroup.
+	queue *BuildQueue
+	group string
+}
+
+var (
+	lastBuildIDMu sync.Mutex
+	lastBuildID   int64
+)
+
+// Build IDs are the time in nanoseconds, in hex, bumped if necessary so that
+// no two are the same.
+func newBuildID() string {
+	lastBuildIDMu.Lock()
+	defer lastBuildIDMu.Unlock()
+
+	id := time.Now().UnixNano()
+	if id <= lastBuildID {
+		id = lastBuildID + 1
+	}
+	lastBuildID = id
+	return fmt.Sprintf("%x", id)
+}
+
+// The github name of the repository being built, e.g, scraperwiki/tang
+func (r BuildRecord) RepoName() string {
+	return path.Join(r.Repository.Organization, r.Repository.Name)
+}
+
+// True if `newer` is for the same ref of the same repository but a different
+// commit, making this build pointless. Tags are never superseded, each is a
+// release in its own right (and their sha might not be known yet).
+func (b *Build) SupersededBy(newer *Build) bool {
+	return b.RepoName() == newer.RepoName() &&
+		b.Repository.Provider == newer.Repository.Provider && b.Ref == newer.Ref &&
+		!strings.HasPrefix(b.Ref, "refs/tags/") && b.Sha != newer.Sha
+}
+
+// The ID of an earlier build of the same commit of a tag for the same reason,
+// e.g, the push of a tag, and the create event for it. Empty if there isn't
+// one.
+func (b *Build) duplicateOf() string {
+	if !strings.HasPrefix(b.Ref, "refs/tags/") {
+		return ""
+	}
+	for _, r := range buildStore.List() {
+		switch {
+		case r.ID == b.ID || r.RepoName() != b.RepoName() ||
+			r.Repository.Provider != b.Repository.Provider:
+		case r.Ref != b.Ref || r.Sha != b.Sha || r.Release != b.Release:
+		case r.State == StateQueued || r.State == StateSuperseded ||
+			r.State == StateInterrupted:
+		default:
+			return r.ID
+		}
+	}
+	return ""
+}
+
+// Find out which commit a build of a ref (e.g, a tag) is for, when the event
+// didn't say.
+func (b *Build) resolveSha(git_dir string) (err error) {
+	err = gitLocalMirror(b.Repository, git_dir, os.Stdout)
+	if err != nil {
+		return fmt.Errorf("Failed to update git mirror: %q", err)
+	}
+	sha, err := gitRevParse(git_dir, b.Checkout+"^{commit}")
+	if err != nil {
+		return fmt.Errorf("Unable to resolve %v: %q", b.Checkout, err)
+	}
+	b.Sha = strings.TrimSpace(sha)
+	b.Checkout = b.Sha
+	b.save()
+	return
+}
+
+// Stop a running build because `sha` was pushed to the same ref.
+func (b *Build) Cancel(sha string) {
+	b.cancelOnce.Do(func() {
+		b.supersededBy = sha
+		close(b.cancel)
+	})
+}
+
+// True if Cancel() has been called.
+func (b *Build) Cancelled() bool {
+	select {
+	case <-b.cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+// Block until the build has finished, returning its error.
+func (b *Build) Wait() error {
+	<-b.done
+	return b.err
+}
+
+// Record the build in the store.
+func (b *Build) save() {
+	err := buildStore.Save(b.BuildRecord)
+	if err != nil {
+		log.Printf("Failed to save build %v: %v", b.ID, err)
+	}
+}
+
+// Github refuses longer status descriptions
+const maxStatusDescription = 140
+
+// The github status context of the build itself.
+func (b *Build) context() string {
+	if b.repoFile != nil && b.repoFile.Context != "" {
+		return b.repoFile.Context
+	}
+	return BuildContext
+}
+
+// Send a status of the build to github and record it against the build.
+func (b *Build) report(s GithubStatus) {
+	s.Context = b.context()
+	if s.State != "pending" {
+		b.State = s.State
+	}
+	b.forward(s)
+}
+
+// Send a status to github and record it against the build, without it
+// affecting the build's state, e.g, for a context reported by tang.hook.
+func (b *Build) forward(s GithubStatus) {
+	if len(s.Description) > maxStatusDescription {
+		s.Description = s.Description[:maxStatusDescription-3] + "..."
+	}
+	b.Statuses = append(b.Statuses, s)
+	b.save()
+	updateStatus(b.Repository.Provider, b.RepoName(), b.Sha, s)
+}
+
+// Record the end of a build which returned `err`.
+func (b *Build) finish(err error) {
+	b.Finished = time.Now()
+	switch {
+	case err == ErrSuperseded:
+		b.State = StateSuperseded
+	case b.State != StateRunning:
+		// Already reported to github
+	case err != nil:
+		b.State = StateError
+	default:
+		// No tang.hook, or asked not to build
+		b.State = StateSkipped
+	}
+	if err != nil {
+		b.Error = err.Error()
+	}
+	b.save()
+	if b.check != nil {
+		b.check.complete(b.BuildRecord)
+	}
+}
+
+// Send an error status for each build which tang was running, or had queued,
+// when it last exited. Otherwise github would show them as pending forever.
+func reportInterrupted(store *BuildStore) {
+	for _, id := range store.interrupted {
+		r, _ := store.Get(id)
+		if r.Sha == "" {
+			// A tag which was never resolved, github hasn't heard of it
+			continue
+		}
+		// The build's own status comes first, its context could have come
+		// from its tang.yml.
+		context := BuildContext
+		if len(r.Statuses) > 0 {
+			context = r.Statuses[0].Context
+		}
+		s := GithubStatus{State: "error", Context: context,
+			TargetUrl:   tangURL(r.LogPath),
+			Description: "Interrupted by tang restart"}
+		r.Statuses = append(r.Statuses, s)
+		err := store.Save(r)
+		if err != nil {
+			log.Printf("Failed to save build %v: %v", r.ID, err)
+		}
+		updateStatus(r.Repository.Provider, r.RepoName(), r.Sha, s)
+	}
+}
+
+// Whether the push changed any files matching the path filter from tang.yml,
+// or tang's config if tang.yml hasn't got one. True if there is no filter,
+// or the changes can't be known (e.g, for a new branch).
+func (b *Build) touchesPaths(git_dir, checkout string, logW io.Writer) bool {
+	var paths Filter
+	if rc := tangConfig.Repo(b.RepoName()); rc.Paths != nil {
+		paths = *rc.Paths
+	}
+	if b.repoFile != nil && !b.repoFile.Paths.Empty() {
+		paths = b.repoFile.Paths
+	}
+	if paths.Empty() {
+		return true
+	}
+
+	files := b.changedFiles
+	if files == nil {
+		if b.Before == "" || b.Before == zeroSha {
+			return true
+		}
+		var err error
+		files, err = gitChangedFiles(git_dir, b.Before, checkout)
+		if err != nil {
+			// e.g, `before` is gone after a force push
+			fmt.Fprintln(logW, "Unable to find changed files:", err)
+			return true
+		}
+	}
+	return paths.MatchAny(files)
+}
+
+// Put a build in the queue, waiting for it to finish if that is what the
+// event asked for.
+func submitBuild(b *Build) (err error) {
+	// With -organization, github sends events for every repository
+	if b.Repository.Provider == "" && !watching(b.RepoName()) {
+		log.Printf("Ignoring %v event for %v, not watched", b.Event, b.RepoName())
+		return ErrRepoNotWatched
+	}
+
+	err = buildQueue.Submit(b)
+	if err != nil {
+		return
+	}
+	if b.NonGithub.Wait {
+		return b.Wait()
+	}
+	return
+}
+
+// Update the mirror, check out the build and run its tang.hook, reporting the
+// result to github.
+func runBuild(b *Build) (err error) {
+	gh_repo := b.RepoName()
+
+	// The name of the subdirectory where the git
+	// mirror is (or will appear, if it hasn't been
+	// cloned yet). Those of other providers than
+	// github are kept apart.
+	git_dir := path.Join(GIT_BASE_DIR, b.Repository.Provider, gh_repo)
+
+	if b.Sha == "" {
+		err = b.resolveSha(git_dir)
+		if err != nil {
+			return
+		}
+	}
+	if id := b.duplicateOf(); id != "" {
+		log.Printf("%v %v %v was built by %v, skipping", gh_repo, b.Ref, b.Sha, id)
+		return
+	}
+	// The check run of a build which was queued without a sha, see Submit
+	if *useChecks && b.Repository.Provider == "" && b.check == nil {
+		b.check = newCheckRun(gh_repo)
+		b.check.create(b.Sha)
+	}
+
+	logPath, diskLogPath, err := getLogPath(b)
+	if err != nil {
+		return
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if b.LogPath != "" {
+		// Run again after waiting for its concurrency group
+		flags = os.O_WRONLY | os.O_APPEND
+	}
+	tangLog, err := os.OpenFile(diskLogPath, flags, 0666)
+	if err != nil {
+		return
+	}
+	defer tangLog.Close()
+
+	b.LogPath = logPath
+	b.save()
+
+	logWriter := io.MultiWriter(os.Stdout, tangLog)
+
+	// Update our local mirror
+	err = gitLocalMirror(b.Repository, git_dir, logWriter)
+	if err != nil {
+		err = fmt.Errorf("Failed to update git mirror: %q", err)
+		infoURL := tangURL("")
+		b.report(GithubStatus{State: "failure", TargetUrl: infoURL,
+			Description: err.Error()})
+		return
+	}
+
+	if b.Cancelled() {
+		fmt.Fprintln(logWriter, "Superseded by", b.supersededBy)
+		return ErrSuperseded
+	}
+
+	checkout := b.Checkout
+	if checkout != b.Sha {
+		// Pin down a ref (e.g, a pull request merge) to the sha it is now.
+		checkout, err = gitRevParse(git_dir, b.Checkout)
+		if err != nil {
+			err = fmt.Errorf("Unable to resolve %v: %q", b.Checkout, err)
+			infoURL := tangURL("")
+			b.report(GithubStatus{State: "failure", TargetUrl: infoURL,
+				Description: err.Error()})
+			return
+		}
+		checkout = strings.TrimSpace(checkout)
+		fmt.Fprintln(logWriter, "Resolved", b.Checkout, "to", checkout)
+	}
+
+	// The repository's tang.yml, if there is one. A broken one is the
+	// commit's fault, so it gets a red light.
+	b.repoFile, err = readRepoFile(git_dir, checkout)
+	if err != nil {
+		fmt.Fprintln(logWriter, err)
+		infoURL := tangURL(logPath)
+		b.report(GithubStatus{State: "failure", TargetUrl: infoURL,
+			Description: err.Error()})
+		return
+	}
+
+	if rf := b.repoFile; rf != nil {
+		if b.PullRequest != 0 && !rf.BuildPullRequests() {
+			fmt.Fprintf(logWriter, "%v says not to build pull requests, exiting.\n", RepoFileName)
+			return
+		}
+		if !refIncluded(b.Ref, rf.Branches, rf.Tags) {
+			fmt.Fprintf(logWriter, "%v excludes %v, exiting.\n", RepoFileName, b.Ref)
+			return
+		}
+	}
+
+	if b.repoFile == nil || b.repoFile.Hook == "" {
+		// Check if we there is a tang hook
+		tang_hook_present, err := gitHaveFile(git_dir, checkout, "tang.hook")
+		if err != nil || !tang_hook_present {
+			// Bail out, error or no tang.hook.
+			fmt.Fprintln(logWriter, "No tang.hook, exiting.")
+			return err
+		}
+	}
+
+	if !b.touchesPaths(git_dir, checkout, logWriter) {
+		fmt.Fprintln(logWriter, "No relevant files changed, skipping.")
+		infoURL := tangURL(logPath)
+		b.report(GithubStatus{State: "success", TargetUrl: infoURL,
+			Description: "Skipped, no relevant files changed"})
+		b.State = StateSkipped
+		return
+	}
+	if b.NonGithub.NoBuild {
+		fmt.Fprintln(logWriter, "Instructed not to build, exiting.")
+		return
+	}
+
+	// Wait in the queue, rather than tying up a worker.
+	if rf := b.repoFile; rf != nil && rf.Concurrency != "" && b.queue != nil {
+		if !b.queue.joinGroup(b, rf.Concurrency) {
+			fmt.Fprintln(logWriter, "Waiting for concurrency group", rf.Concurrency)
+			return ErrGroupBusy
+		}
+	}
+	fmt.Fprintln(logWriter, "Checkout..")
+
+	// Only use 6 characters of sha for the name of the
+	// directory checked out for this repository by tang.
+	checkout_dir := path.Join("checkout", checkout[:6])
+
+	// Checkout the target sha
+	err = gitCheckout(git_dir, checkout_dir, checkout)
+	if err != nil {
+		return
+	}
+
+	log.Println("Created", checkout_dir)
+
+	// TODO(pwaller): One day this will have more information, e.g, QA link.
+	infoURL := tangURL(logPath)
+
+	repo_workdir := path.Join(git_dir, checkout_dir)
+	if b.check != nil {
+		b.check.start(b.Sha, infoURL, repo_workdir)
+	}
+
+	// Set the state of the commit to "in progress" (seen as yellow in
+	// a github pull request)
+	b.report(GithubStatus{State: "pending", TargetUrl: infoURL,
+		Description: "Running"})
+
+	// Run the tang script for the repository, if there is one.
+	err = runTang(gh_repo, repo_workdir, logWriter, b)
+
+	switch err {
+	case nil:
+		// All OK, send along a green
+		b.report(GithubStatus{State: "success", TargetUrl: infoURL,
+			Description: "Tests passed"})
+
+	case ErrSuperseded:
+		// Not OK, but not the fault of this commit either.
+		b.report(GithubStatus{State: "error", TargetUrl: infoURL,
+			Description: "Superseded by " + b.supersededBy})
+
+	default:
+		// Not OK, send along red.
+		b.report(GithubStatus{State: "failure", TargetUrl: infoURL,
+			Description: err.Error()})
+	}
+	return
+}
@@ -0,0 +1,285 @@
+package main
+
+// Reporting builds as github check runs, which unlike statuses can carry a
+// summary, the end of the log and annotations on the lines which failed.
+// http://developer.github.com/v3/checks/runs/
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Github takes at most this many annotations per request
+	maxAnnotationsPerRequest = 50
+	// and we don't send more than this many for a build
+	maxAnnotations = 10 * maxAnnotationsPerRequest
+	// Lines from the end of the log shown in the check run
+	checkLogTail = 60
+	// Github refuses longer output text
+	maxCheckText = 60000
+)
+
+// The check run of one build. Updates are sent in order by a goroutine of
+// its own, so that the build never waits for github.
+type checkRun struct {
+	repo    string
+	updates chan checkUpdate
+}
+
+type checkUpdate struct {
+	kind    string // "create", "start" or "complete"
+	sha     string
+	url     string
+	workdir string // where the hook ran, stripped from annotation paths
+	record  BuildRecord
+}
+
+func newCheckRun(repo string) *checkRun {
+	c := &checkRun{repo: repo, updates: make(chan checkUpdate, 4)}
+	go c.run()
+	return c
+}
+
+// Create the check run, in the queued state, if it hasn't been already.
+func (c *checkRun) create(sha string) {
+	c.updates <- checkUpdate{kind: "create", sha: sha}
+}
+
+// The build has started running in `workdir`, its log is at `url`.
+func (c *checkRun) start(sha, url, workdir string) {
+	c.updates <- checkUpdate{kind: "create", sha: sha}
+	c.updates <- checkUpdate{kind: "start", url: url, workdir: workdir}
+}
+
+// The build has finished, `record` says how.
+func (c *checkRun) complete(record BuildRecord) {
+	c.updates <- checkUpdate{kind: "complete", record: record}
+	close(c.updates)
+}
+
+func (c *checkRun) run() {
+	var (
+		id           int64
+		tried        bool
+		url, workdir string
+	)
+	for u := range c.updates {
+		switch u.kind {
+		case "create":
+			if tried {
+				continue
+			}
+			tried = true
+			id = createCheckRun(c.repo, u.sha)
+
+		case "start":
+			url, workdir = u.url, u.workdir
+			if id != 0 {
+				c.update(id, map[string]interface{}{
+					"status":      "in_progress",
+					"started_at":  time.Now().UTC(),
+					"details_url": url,
+				})
+			}
+
+		case "complete":
+			if id != 0 {
+				c.finish(id, u.record, url, workdir)
+			}
+		}
+	}
+}
+
+func createCheckRun(repo, sha string) (id int64) {
+	payload, _ := json.Marshal(map[string]string{
+		"name":     BuildContext,
+		"head_sha": sha,
+		"status":   "queued",
+	})
+	response, resp, err := githubClient.Do("POST", string(payload), "repos", repo, "check-runs")
+	switch {
+	case err == ErrSkipGithubEndpoint:
+		return 0
+	case err != nil:
+		log.Printf("Failed to create check run for %v %v: %v", repo, sha, err)
+		return 0
+	case resp.StatusCode != http.StatusCreated:
+		log.Printf("Failed to create check run for %v %v: %v %v", repo, sha,
+			resp.Status, response)
+		return 0
+	}
+	var run struct {
+		ID int64 `json:"id"`
+	}
+	json.Unmarshal([]byte(response), &run)
+	return run.ID
+}
+
+func (c *checkRun) update(id int64, fields map[string]interface{}) {
+	payload, err := json.Marshal(fields)
+	check(err)
+	response, resp, err := githubClient.Do("PATCH", string(payload),
+		"repos", c.repo, "check-runs", strconv.FormatInt(id, 10))
+	switch {
+	case err != nil:
+		log.Printf("Failed to update check run %v of %v: %v", id, c.repo, err)
+	case resp.StatusCode != http.StatusOK:
+		log.Printf("Failed to update check run %v of %v: %v %v", id, c.repo,
+			resp.Status, response)
+	}
+}
+
+// Complete the check run, with the annotations in batches as github wants.
+func (c *checkRun) finish(id int64, r BuildRecord, url, workdir string) {
+	logText, err := ioutil.ReadFile(r.LogPath)
+	if err != nil && r.LogPath != "" {
+		log.Printf("Unable to read log for check run: %v", err)
+	}
+
+	level := "warning"
+	if r.State == StateFailure {
+		level = "failure"
+	}
+	prefix := ""
+	if workdir != "" {
+		if abs, err := filepath.Abs(workdir); err == nil {
+			prefix = abs + "/"
+		}
+	}
+	annotations := parseAnnotations(logText, prefix, level)
+
+	title := r.State
+	if len(r.Statuses) > 0 {
+		title = r.Statuses[len(r.Statuses)-1].Description
+	}
+	output := map[string]interface{}{
+		"title":   title,
+		"summary": checkSummary(r, url),
+		"text":    "```\n" + logTail(logText) + "\n```",
+	}
+
+	// The first batch goes with the conclusion, github adds later ones to
+	// those already there.
+	for first := true; first || len(annotations) > 0; first = false {
+		batch := annotations
+		if len(batch) > maxAnnotationsPerRequest {
+			batch = batch[:maxAnnotationsPerRequest]
+		}
+		annotations = annotations[len(batch):]
+		output["annotations"] = batch
+
+		fields := map[string]interface{}{"output": output}
+		if first {
+			fields["status"] = "completed"
+			fields["conclusion"] = checkConclusion(r.State)
+			fields["completed_at"] = time.Now().UTC()
+		}
+		c.update(id, fields)
+	}
+}
+
+// The github check conclusion for a build which finished in `state`.
+func checkConclusion(state string) string {
+	switch state {
+	case StateSuccess:
+		return "success"
+	case StateFailure, StateError:
+		return "failure"
+	case StateSkipped:
+		return "skipped"
+	}
+	// Superseded or interrupted
+	return "cancelled"
+}
+
+func checkSummary(r BuildRecord, url string) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Build `%v` of `%v` at `%v`: **%v**\n\n", r.ID, shortRef(r.Ref),
+		shortSha(r.Sha), r.State)
+	if r.Started.IsZero() {
+		fmt.Fprintf(&b, "* Never started\n")
+	} else {
+		fmt.Fprintf(&b, "* Took %v\n", roundDuration(r.Duration()))
+	}
+	if r.ExitStatus != nil {
+		fmt.Fprintf(&b, "* `tang.hook` exited with status %d\n", *r.ExitStatus)
+	}
+	if r.Error != "" {
+		fmt.Fprintf(&b, "* %v\n", r.Error)
+	}
+	if url != "" {
+		fmt.Fprintf(&b, "* [Full log](%v)\n", url)
+	}
+	return b.String()
+}
+
+// The last few lines of the log, short enough for github.
+func logTail(logText []byte) string {
+	lines := strings.Split(strings.TrimRight(string(logText), "\n"), "\n")
+	if len(lines) > checkLogTail {
+		lines = lines[len(lines)-checkLogTail:]
+	}
+	tail := strings.Join(lines, "\n")
+	if len(tail) > maxCheckText {
+		tail = tail[len(tail)-maxCheckText:]
+	}
+	// Don't let the log end the code block early
+	return strings.Replace(tail, "```", "'''", -1)
+}
+
+// http://developer.github.com/v3/checks/runs/#annotations-object
+type checkAnnotation struct {
+	Path            string `json:"path"`
+	StartLine       int    `json:"start_line"`
+	EndLine         int    `json:"end_line"`
+	StartColumn     int    `json:"start_column,omitempty"`
+	EndColumn       int    `json:"end_column,omitempty"`
+	AnnotationLevel string `json:"annotation_level"`
+	Message         string `json:"message"`
+}
+
+// file.go:12: message, or file.go:12:5: message, as printed by the go
+// compiler, go vet and t.Errorf in go test (indented).
+var annotationLine = regexp.MustCompile(`^\s*(\S+\.\w+):(\d+):(?:(\d+):)? (.+)$`)
+
+// Annotations for the lines of `logText` which point at a file. Paths are
+// made relative to the repository by removing `prefix` (where the hook ran)
+// or "./".
+func parseAnnotations(logText []byte, prefix, level string) (annotations []checkAnnotation) {
+	seen := map[string]bool{}
+	for _, line := range strings.Split(string(logText), "\n") {
+		m := annotationLine.FindStringSubmatch(line)
+		if m == nil || seen[line] {
+			continue
+		}
+		seen[line] = true
+
+		path := strings.TrimPrefix(strings.TrimPrefix(m[1], prefix), "./")
+		if filepath.IsAbs(path) || strings.HasPrefix(path, "../") {
+			// Not in the repository
+			continue
+		}
+		a := checkAnnotation{Path: path, AnnotationLevel: level, Message: m[4]}
+		a.StartLine, _ = strconv.Atoi(m[2])
+		a.EndLine = a.StartLine
+		if m[3] != "" {
+			a.StartColumn, _ = strconv.Atoi(m[3])
+			a.EndColumn = a.StartColumn
+		}
+		annotations = append(annotations, a)
+		if len(annotations) == maxAnnotations {
+			break
+		}
+	}
+	return
+}
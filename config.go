@@ -0,0 +1,180 @@
+package main
+
+// Tang's own configuration, read from the file given by -config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Replaced in main() if -config is given
+var tangConfig = &Config{}
+
+// Example:
+//
+//	{
+//		"defaults": {"supersede": true, "timeout": "30m"},
+//		"repositories": {
+//			"scraperwiki/tang": {"supersede": false, "timeout": "5m",
+//				"branches": {"include": ["master", "release-*"]},
+//				"tags": {"exclude": ["*"]},
+//				"paths": {"include": ["services/api/**"]}}
+//		},
+//		"organization": {
+//			"names": {"exclude": ["*-archive"]},
+//			"topics": {"include": ["tang"]}
+//		}
+//	}
+type Config struct {
+	// Settings for every repository, overriding the command line flags
+	Defaults RepoConfig `json:"defaults"`
+
+	// Settings for individual repositories, keyed by e.g "scraperwiki/tang"
+	Repositories map[string]RepoConfig `json:"repositories"`
+
+	// Which repositories of -organization to watch, see OrgConfig
+	Organization OrgConfig `json:"organization"`
+}
+
+// Repositories are chosen by name (without the organization, e.g "tang")
+// and by their github topics. A repository is watched if its name matches,
+// and it has one of the included topics (if there are any) and none of the
+// excluded ones.
+type OrgConfig struct {
+	Names  Filter `json:"names"`
+	Topics Filter `json:"topics"`
+}
+
+// Settings which can be made per repository. Unset (nil) fields fall back to
+// the defaults.
+type RepoConfig struct {
+	// Drop or cancel builds of a ref when a newer commit is pushed to it
+	Supersede *bool `json:"supersede,omitempty"`
+
+	// How long tang.hook may run for before it is killed, zero is forever
+	Timeout *Duration `json:"timeout,omitempty"`
+
+	// Which branches and tags to build, see refIncluded(). Pushes to other
+	// refs are ignored before anything is checked out.
+	Branches *Filter `json:"branches,omitempty"`
+	Tags     *Filter `json:"tags,omitempty"`
+
+	// Only build pushes which change a file matching this, see Filter
+	Paths *Filter `json:"paths,omitempty"`
+}
+
+// A time.Duration written in JSON as a string, e.g "1h30m"
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) (err error) {
+	var s string
+	err = json.Unmarshal(data, &s)
+	if err != nil {
+		return
+	}
+	d.Duration, err = time.ParseDuration(s)
+	return
+}
+
+func loadConfig(filename string) (config *Config, err error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+
+	config = &Config{}
+	err = json.NewDecoder(fd).Decode(config)
+	if err != nil {
+		return
+	}
+
+	err = config.Defaults.validate()
+	if err != nil {
+		return nil, fmt.Errorf("%v: defaults: %v", filename, err)
+	}
+	for repo, rc := range config.Repositories {
+		err = rc.validate()
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v: %v", filename, repo, err)
+		}
+	}
+	for name, filter := range map[string]Filter{
+		"names":  config.Organization.Names,
+		"topics": config.Organization.Topics,
+	} {
+		err = filter.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("%v: organization: %v: %v", filename, name, err)
+		}
+	}
+	return
+}
+
+func (rc RepoConfig) validate() error {
+	for name, filter := range map[string]*Filter{
+		"branches": rc.Branches,
+		"tags":     rc.Tags,
+		"paths":    rc.Paths,
+	} {
+		if filter == nil {
+			continue
+		}
+		if err := filter.Validate(); err != nil {
+			return fmt.Errorf("%v: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Whether pushes to `ref` should be built at all.
+func (rc RepoConfig) BuildsRef(ref string) bool {
+	var branches, tags Filter
+	if rc.Branches != nil {
+		branches = *rc.Branches
+	}
+	if rc.Tags != nil {
+		tags = *rc.Tags
+	}
+	return refIncluded(ref, branches, tags)
+}
+
+// The settings for `repo`: the command line flags, overridden by the config
+// defaults, overridden by the repository's own settings.
+func (c *Config) Repo(repo string) RepoConfig {
+	rc := RepoConfig{
+		Supersede: supersede,
+		Timeout:   &Duration{*hookTimeout},
+	}
+	rc = rc.merge(c.Defaults)
+	rc = rc.merge(c.Repositories[repo])
+	return rc
+}
+
+// Settings from `over` take precedence where they are set.
+func (rc RepoConfig) merge(over RepoConfig) RepoConfig {
+	if over.Supersede != nil {
+		rc.Supersede = over.Supersede
+	}
+	if over.Timeout != nil {
+		rc.Timeout = over.Timeout
+	}
+	if over.Branches != nil {
+		rc.Branches = over.Branches
+	}
+	if over.Tags != nil {
+		rc.Tags = over.Tags
+	}
+	if over.Paths != nil {
+		rc.Paths = over.Paths
+	}
+	return rc
+}
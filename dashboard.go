@@ -0,0 +1,202 @@
+package main
+
+// The dashboard at /tang/
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How many finished builds to show for each repository
+const dashboardRecent = 10
+
+type dashboard struct {
+	Running, Waiting []BuildRecord
+	Repositories     []repositoryBuilds
+	Now              time.Time
+
+	// Statuses which haven't been sent to github yet
+	UnsentStatuses int
+}
+
+type repositoryBuilds struct {
+	Name   string
+	Builds []BuildRecord
+}
+
+// HTTP handler for /tang/
+func handleTang(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/tang/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	d := dashboard{Now: time.Now(), UnsentStatuses: statusOutbox.Len()}
+
+	running, waiting := buildQueue.Snapshot()
+	for _, b := range running {
+		if record, ok := buildStore.Get(b.ID); ok {
+			d.Running = append(d.Running, record)
+		}
+	}
+	for _, b := range waiting {
+		if record, ok := buildStore.Get(b.ID); ok {
+			d.Waiting = append(d.Waiting, record)
+		}
+	}
+	sort.Sort(byQueued(d.Running))
+
+	// Most recent finished builds, grouped by repository
+	byRepo := map[string]*repositoryBuilds{}
+	for _, record := range buildStore.List() {
+		if record.State == StateQueued || record.State == StateRunning {
+			continue
+		}
+		name := record.RepoName()
+		repo, ok := byRepo[name]
+		if !ok {
+			repo = &repositoryBuilds{Name: name}
+			byRepo[name] = repo
+		}
+		if len(repo.Builds) < dashboardRecent {
+			repo.Builds = append(repo.Builds, record)
+		}
+	}
+	for _, repo := range byRepo {
+		d.Repositories = append(d.Repositories, *repo)
+	}
+	sort.Sort(byRepositoryName(d.Repositories))
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := dashboardTemplate.Execute(w, d)
+	if err != nil {
+		log.Println("Error rendering dashboard:", err)
+	}
+}
+
+type byRepositoryName []repositoryBuilds
+
+func (r byRepositoryName) Len() int           { return len(r) }
+func (r byRepositoryName) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byRepositoryName) Less(i, j int) bool { return r[i].Name < r[j].Name }
+
+// "refs/heads/master" is more readable as "master"
+func shortRef(ref string) string {
+	for _, prefix := range []string{"refs/heads/", "refs/tags/"} {
+		if strings.HasPrefix(ref, prefix) {
+			return ref[len(prefix):]
+		}
+	}
+	return ref
+}
+
+func shortSha(sha string) string {
+	if len(sha) > 6 {
+		return sha[:6]
+	}
+	return sha
+}
+
+// A duration to the nearest second
+func roundDuration(d time.Duration) time.Duration {
+	return d - d%time.Second
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"shortRef": shortRef,
+	"shortSha": shortSha,
+	"round":    roundDuration,
+	"since":    func(t time.Time) time.Duration { return roundDuration(time.Since(t)) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="10">
+<title>tang</title>
+<style>
+html, body { font-family: sans-serif; margin: 0; padding: 0; color: #222; }
+body { padding: 1em 2em; }
+h1 { font-size: 1.6em; }
+h2 { font-size: 1.2em; margin-top: 1.5em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 0.2em 0.6em; border-bottom: 1px solid #ddd; }
+th { font-weight: normal; color: #777; }
+code { font-size: 0.9em; }
+.state { font-weight: bold; border-radius: 3px; padding: 0 0.4em; color: #fff; }
+.success { background: #2a2; }
+.failure { background: #c22; }
+.error { background: #822; }
+.queued, .running { background: #d90; }
+.skipped, .superseded, .interrupted { background: #999; }
+.empty { color: #999; }
+.warning { color: #c22; }
+</style>
+</head>
+<body>
+<h1>tang</h1>
+{{with .UnsentStatuses}}<p class="warning">{{.}} status update{{if gt . 1}}s{{end}} waiting to be sent to github.</p>{{end}}
+
+<h2>Running</h2>
+{{with .Running}}
+<table>
+<tr><th>repository</th><th>ref</th><th>sha</th><th>pusher</th><th>running for</th><th></th></tr>
+{{range .}}
+<tr>
+<td>{{.RepoName}}</td>
+<td>{{shortRef .Ref}}</td>
+<td><code>{{shortSha .Sha}}</code></td>
+<td>{{.Pusher.Name}}</td>
+<td>{{since .Started}}</td>
+<td>{{if .LogPath}}<a href="/tang/{{.LogPath}}">log</a>{{end}}</td>
+</tr>
+{{end}}
+</table>
+{{else}}
+<p class="empty">Nothing running.</p>
+{{end}}
+
+<h2>Queue</h2>
+{{with .Waiting}}
+<table>
+<tr><th>repository</th><th>ref</th><th>sha</th><th>pusher</th><th>waiting for</th></tr>
+{{range .}}
+<tr>
+<td>{{.RepoName}}</td>
+<td>{{shortRef .Ref}}</td>
+<td><code>{{shortSha .Sha}}</code></td>
+<td>{{.Pusher.Name}}</td>
+<td>{{since .Queued}}</td>
+</tr>
+{{end}}
+</table>
+{{else}}
+<p class="empty">Nothing waiting.</p>
+{{end}}
+
+{{range .Repositories}}
+<h2>{{.Name}}</h2>
+<table>
+<tr><th>state</th><th>ref</th><th>sha</th><th>pusher</th><th>event</th><th>finished</th><th>took</th><th></th></tr>
+{{range .Builds}}
+<tr>
+<td><span class="state {{.State}}">{{.State}}</span></td>
+<td>{{shortRef .Ref}}</td>
+<td><code>{{shortSha .Sha}}</code></td>
+<td>{{.Pusher.Name}}</td>
+<td>{{.Event}}</td>
+<td>{{.Finished.Format "2006-01-02 15:04:05"}}</td>
+<td>{{round .Duration}}</td>
+<td>{{if .LogPath}}<a href="/tang/{{.LogPath}}">log</a>{{end}}</td>
+</tr>
+{{end}}
+</table>
+{{end}}
+
+<p class="empty">{{.Now.Format "2006-01-02 15:04:05 MST"}}</p>
+</body>
+</html>
+`))
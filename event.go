@@ -4,18 +4,33 @@ package main
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 )
 
+var (
+	ErrMissingSignature = errors.New("Missing X-Hub-Signature-256 or X-Hub-Signature header")
+	ErrBadSignature     = errors.New("Webhook signature mismatch")
+	ErrNoLogDir         = errors.New("Build has no log directory")
+)
+
 var jsonLogFile, _ = os.Create("logs/json.log")
 var jsonLog = log.New(jsonLogFile, "", log.LstdFlags)
 
@@ -47,6 +62,63 @@ func handleEvent(eventType string, document []byte) (err error) {
 			return
 		}
 
+	case "pull_request":
+
+		var event PullRequestEvent
+		err = json.Unmarshal(document, &event)
+		if err != nil {
+			return
+		}
+
+		switch event.Action {
+		case "opened", "synchronize", "reopened":
+		default:
+			log.Println("Ignoring pull request action:", event.Action)
+			return
+		}
+
+		err = eventPullRequest(event)
+		if err != nil {
+			return
+		}
+
+	case "create":
+
+		var event CreateEvent
+		err = json.Unmarshal(document, &event)
+		if err != nil {
+			return
+		}
+
+		// New branches arrive as a push too. So do new tags, except when
+		// several are pushed at once.
+		if event.RefType != "tag" {
+			return
+		}
+
+		err = eventCreateTag(event)
+		if err != nil {
+			return
+		}
+
+	case "release":
+
+		var event ReleaseEvent
+		err = json.Unmarshal(document, &event)
+		if err != nil {
+			return
+		}
+
+		if event.Action != "published" || event.Release.Draft {
+			log.Println("Ignoring release action:", event.Action)
+			return
+		}
+
+		err = eventRelease(event)
+		if err != nil {
+			return
+		}
+
 	default:
 		log.Println("Unhandled event:", eventType)
 	}
@@ -56,7 +128,8 @@ func handleEvent(eventType string, document []byte) (err error) {
 
 // HTTP handler for /hook
 // It is expecting a POST with a JSON payload according to
-// http://developer.github.com/v3/activity/events/
+// http://developer.github.com/v3/activity/events/, or from one of the other
+// providers, see Provider.
 func handleHook(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method != "POST" {
@@ -68,6 +141,22 @@ func handleHook(w http.ResponseWriter, r *http.Request) {
 	request, err := ioutil.ReadAll(r.Body)
 	check(err)
 
+	provider := detectProvider(r.Header)
+	if provider == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Expected X-Github-Event, X-Gitea-Event, X-Gitlab-Event or X-Event-Key header.\n")
+		log.Println("No event header. NOOP")
+		return
+	}
+
+	err = provider.Verify(r.Header, request)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "Bad signature.\n")
+		log.Printf("Rejecting %v hook from %v: %v", provider.Name(), r.RemoteAddr, err)
+		return
+	}
+
 	var buf bytes.Buffer
 	// r.Header.Write(&buf)
 	// log.Println("Incoming request headers: ", string(buf.Bytes()))
@@ -81,32 +170,31 @@ func handleHook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if len(r.Header["X-Github-Event"]) != 1 {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "Expected X-Github-Event header.\n")
-		log.Println("No X-Github-Event header. NOOP")
-		return
-	}
-	eventType := r.Header["X-Github-Event"][0]
+	eventType := provider.EventType(r.Header)
 	data := buf.Bytes()
 
 	// Check to see if we have data from somewhere which is not github
 	j, err := ParseJustNongithub(request)
-	if !j.NonGithub.Wait {
-		go func() {
-			err := handleEvent(eventType, data)
-			if err != nil {
-				log.Printf("Error processing %v %v %q", eventType, string(data), err)
-			}
-		}()
 
+	// Handle the event, which queues a build. This only blocks until the
+	// build is finished if the event asks us to wait.
+	err = provider.Handle(eventType, data)
+	if err == ErrQueueFull {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "Build queue is full, try again later.\n")
+		log.Printf("Queue full, dropping %v event", eventType)
+		return
+	}
+
+	if !j.NonGithub.Wait {
+		if err != nil {
+			log.Printf("Error processing %v %v %q", eventType, string(data), err)
+		}
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintf(w, "OK. Not waiting for build.\n")
 		return
 	}
 
-	// Handle the event
-	err = handleEvent(eventType, data)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "Error handling event: %q\n", err)
@@ -118,32 +206,185 @@ func handleHook(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "OK\n")
 }
 
-// Invoked when a respository we are watching changes
-func runTang(repo, repo_path string, logW io.Writer, event PushEvent) (err error) {
+// Verify that `body` was signed by someone who knows `secret`. Github sends
+// an HMAC of the payload in X-Hub-Signature-256 (sha256), and in the legacy
+// X-Hub-Signature (sha1). The former is preferred when both are present.
+// http://developer.github.com/webhooks/securing/
+func checkSignature(header http.Header, body []byte, secret string) error {
+	var (
+		newHash   func() hash.Hash
+		prefix    string
+		signature string
+	)
+
+	if signature = header.Get("X-Hub-Signature-256"); signature != "" {
+		newHash, prefix = sha256.New, "sha256="
+	} else if signature = header.Get("X-Hub-Signature"); signature != "" {
+		newHash, prefix = sha1.New, "sha1="
+	} else {
+		return ErrMissingSignature
+	}
 
-	sha := event.After
-	ref := event.Ref
+	if !strings.HasPrefix(signature, prefix) {
+		return ErrBadSignature
+	}
+	return checkHMAC(newHash, secret, body, signature[len(prefix):])
+}
 
-	// Note: The way the path of this executable is described is important;
-	// see http://code.google.com/p/go/issues/detail?id=7228
-	cmdPath, err := filepath.Abs(path.Join(repo_path, "tang.hook"))
+// Verify that `signature`, in hex, is the HMAC of `body` with `secret`.
+func checkHMAC(newHash func() hash.Hash, secret string, body []byte, signature string) error {
+	got, err := hex.DecodeString(signature)
 	if err != nil {
-		return
+		return ErrBadSignature
+	}
+
+	mac := hmac.New(newHash, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// Invoked when a respository we are watching changes
+func runTang(repo, repo_path string, logW io.Writer, b *Build) (err error) {
+
+	var cmd *exec.Cmd
+	if b.repoFile != nil && b.repoFile.Hook != "" {
+		cmd = Command(repo_path, "sh", "-c", b.repoFile.Hook)
+	} else {
+		// Note: The way the path of this executable is described is important;
+		// see http://code.google.com/p/go/issues/detail?id=7228
+		var cmdPath string
+		cmdPath, err = filepath.Abs(path.Join(repo_path, "tang.hook"))
+		if err != nil {
+			return
+		}
+		cmd = Command(repo_path, cmdPath)
 	}
-	cmd := Command(repo_path, cmdPath)
 	cmd.Stdout = logW
 	cmd.Stderr = logW
+	// Own process group, so that the hook and everything it starts can be
+	// killed together.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 
-	cmd.Env = append(os.Environ(), "TANG_SHA="+sha, "TANG_REF="+ref)
+	cmd.Env = os.Environ()
+	if b.repoFile != nil {
+		cmd.Env = append(cmd.Env, b.repoFile.Environ()...)
+	}
+	cmd.Env = append(cmd.Env, "TANG_SHA="+b.Sha, "TANG_REF="+b.Ref)
+	if b.PullRequest != 0 {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("TANG_PULL_REQUEST=%d", b.PullRequest))
+	}
+	if strings.HasPrefix(b.Ref, "refs/tags/") {
+		cmd.Env = append(cmd.Env, "TANG_TAG="+strings.TrimPrefix(b.Ref, "refs/tags/"))
+	}
+	if b.Release != "" {
+		cmd.Env = append(cmd.Env, "TANG_RELEASE_NAME="+b.Release)
+	}
+
+	// Somewhere for the hook to report statuses of its own, see
+	// hookStatusFile. It is kept with the build's log, and no other build
+	// can write to it.
+	if b.LogPath == "" {
+		return ErrNoLogDir
+	}
+	statuses := &hookStatusFile{}
+	statuses.filename, err = filepath.Abs(path.Join(path.Dir(b.LogPath), "statuses.txt"))
+	if err != nil {
+		return
+	}
+	err = ioutil.WriteFile(statuses.filename, nil, 0666)
+	if err != nil {
+		return
+	}
+	cmd.Env = append(cmd.Env, "TANG_STATUS_FILE="+statuses.filename)
+	infoURL := tangURL(b.LogPath)
 
 	start := time.Now()
-	err = cmd.Run()
+	err = cmd.Start()
+	if err != nil {
+		return
+	}
+
+	hookStarted(cmd)
+	exited := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		hookExited(cmd)
+		exited <- err
+	}()
+
+	timeout := tangConfig.Repo(repo).Timeout.Duration
+	if b.repoFile != nil && b.repoFile.timeout != 0 {
+		timeout = b.repoFile.timeout
+	}
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	poll := time.NewTicker(hookStatusPoll)
+	defer poll.Stop()
+
+wait:
+	for {
+		select {
+		case err = <-exited:
+			break wait
+		case <-poll.C:
+			statuses.forward(b, infoURL, logW, false)
+		case <-b.cancel:
+			fmt.Fprintln(logW, "Superseded by", b.supersededBy, "stopping hook")
+			terminate(repo, cmd, exited, logW)
+			err = ErrSuperseded
+			break wait
+		case <-expired:
+			fmt.Fprintf(logW, "Hook timed out after %v, stopping it\n", timeout)
+			terminate(repo, cmd, exited, logW)
+			err = fmt.Errorf("timed out after %v", timeout)
+			break wait
+		}
+	}
+	statuses.forward(b, infoURL, logW, true)
 	fmt.Fprintf(logW, "Hook took %v\n", time.Since(start))
 
+	if cmd.ProcessState != nil {
+		status := cmd.ProcessState.Sys().(syscall.WaitStatus).ExitStatus()
+		b.ExitStatus = &status
+		b.save()
+	}
+
 	return
 }
 
-func getLogPath(shortSha string) (logPath, diskLogPath string, err error) {
+// Stop the hook `cmd` and everything it started, politely at first. Returns
+// once the hook has exited (which is signalled on `exited`).
+func terminate(repo string, cmd *exec.Cmd, exited <-chan error, logW io.Writer) {
+	err := killProcessGroup(cmd, syscall.SIGTERM)
+	if err != nil {
+		log.Printf("Failed to SIGTERM hook for %v: %v", repo, err)
+	}
+
+	select {
+	case <-exited:
+		return
+	case <-time.After(*killGrace):
+	}
+
+	fmt.Fprintf(logW, "Hook still running after %v, sending SIGKILL\n", *killGrace)
+	err = killProcessGroup(cmd, syscall.SIGKILL)
+	if err != nil {
+		log.Printf("Failed to SIGKILL hook for %v: %v", repo, err)
+	}
+	<-exited
+}
+
+// Every build gets its own log directory,
+// logs/<organization>/<repository>/<sha>/<build id>/
+func getLogPath(b *Build) (logPath, diskLogPath string, err error) {
 
 	pwd, err := os.Getwd()
 	if err != nil {
@@ -151,10 +392,11 @@ func getLogPath(shortSha string) (logPath, diskLogPath string, err error) {
 		return
 	}
 
-	logDir := path.Join("logs", shortSha)
+	logDir := path.Join("logs", b.Repository.Organization, b.Repository.Name,
+		b.Sha, b.ID)
 	err = os.MkdirAll(logDir, 0777)
 	if err != nil {
-		err = fmt.Errorf("getLogPath/MkdirAll(%q): ", logDir, err)
+		err = fmt.Errorf("getLogPath/MkdirAll(%q): %q", logDir, err)
 		return
 	}
 
@@ -163,7 +405,7 @@ func getLogPath(shortSha string) (logPath, diskLogPath string, err error) {
 	return
 }
 
-// Invoked when there is a push event to github.
+// Invoked when there is a push event, from github or another provider.
 func eventPush(event PushEvent) (err error) {
 	if event.Repository.Name == "" {
 		return ErrEmptyRepoName
@@ -178,82 +420,151 @@ func eventPush(event PushEvent) (err error) {
 		return ErrUserNotAllowed
 	}
 
-	gh_repo := path.Join(event.Repository.Organization, event.Repository.Name)
-
 	log.Println("Push to", event.Repository.Url, event.Ref, "after", event.After)
 
-	// Only use 6 characters of sha for the name of the
-	// directory checked out for this repository by tang.
-	shortSha := event.After[:6]
-
-	logPath, diskLogPath, err := getLogPath(shortSha)
-	if err != nil {
+	gh_repo := path.Join(event.Repository.Organization, event.Repository.Name)
+	if !tangConfig.Repo(gh_repo).BuildsRef(event.Ref) {
+		log.Printf("Ignoring push to %v %v, excluded by config", gh_repo, event.Ref)
 		return
 	}
 
-	tangLog, err := os.Create(diskLogPath)
-	if err != nil {
-		return
+	b := &Build{
+		BuildRecord: BuildRecord{
+			Repository: event.Repository,
+			Ref:        event.Ref,
+			Before:     event.Before,
+			Sha:        event.After,
+			Checkout:   event.After,
+			Pusher:     event.Pusher,
+			Event:      "push",
+		},
+		NonGithub: event.NonGithub,
 	}
-	defer tangLog.Close()
+	if files, ok := event.ChangedFiles(); ok {
+		b.changedFiles = files
+	}
+	return submitBuild(b)
+}
 
-	logWriter := io.MultiWriter(os.Stdout, tangLog)
+// Invoked when a pull request is opened, reopened or has new commits pushed
+// to it. The statuses go on the head sha so they show up on the pull request.
+func eventPullRequest(event PullRequestEvent) (err error) {
+	pr := event.PullRequest
+
+	b := &Build{BuildRecord: BuildRecord{
+		Repository:  event.Repository.Repository(),
+		Ref:         fmt.Sprintf("refs/pull/%d/head", event.Number),
+		Sha:         pr.Head.Sha,
+		Checkout:    pr.Head.Sha,
+		Pusher:      Pusher{Name: pr.User.Login},
+		PullRequest: event.Number,
+	}}
+	if *buildPRMerge {
+		// Github maintains this ref as the result of merging the head into
+		// the base, it is resolved after the mirror is updated.
+		b.Ref = fmt.Sprintf("refs/pull/%d/merge", event.Number)
+		b.Checkout = b.Ref
+	}
+	return submitPullRequest(b, event.Action)
+}
 
-	// The name of the subdirectory where the git
-	// mirror is (or will appear, if it hasn't been
-	// cloned yet).
-	git_dir := path.Join(GIT_BASE_DIR, gh_repo)
+// Queue the build of a pull request (or a merge request), from any provider,
+// if its author is allowed.
+func submitPullRequest(b *Build, action string) (err error) {
+	if b.Repository.Name == "" {
+		return ErrEmptyRepoName
+	}
+	if b.Repository.Organization == "" {
+		return ErrEmptyRepoOrganization
+	}
 
-	// Update our local mirror
-	err = gitLocalMirror(event.Repository.Url, git_dir, logWriter)
-	if err != nil {
-		err = fmt.Errorf("Failed to update git mirror: %q", err)
-		infoURL := "http://services.scraperwiki.com/tang/"
-		s := GithubStatus{"failure", infoURL, err.Error()}
-		updateStatus(gh_repo, event.After, s)
-		return
+	// The author of the pull request is the one whose code we would run.
+	if _, ok := allowedPushersSet[b.Pusher.Name]; !ok {
+		log.Printf("Ignoring pull request by %q, not allowed", b.Pusher.Name)
+		return ErrUserNotAllowed
 	}
 
-	// Check if we there is a tang hook
-	tang_hook_present, err := gitHaveFile(git_dir, event.After, "tang.hook")
-	if err != nil || !tang_hook_present || event.NonGithub.NoBuild {
-		// Bail out, error, no tang.hook or instructed not to build it.
-		fmt.Fprintln(logWriter, "No tang.hook, exiting.")
-		return
+	log.Println("Pull request", b.PullRequest, action, "on",
+		b.Repository.Url, "head", b.Sha)
+
+	b.Event = "pull_request"
+	return submitBuild(b)
+}
+
+// Invoked when a tag is created. The event doesn't say which commit is
+// tagged, so that is found once the mirror has been updated.
+func eventCreateTag(event CreateEvent) (err error) {
+	repository := event.Repository.Repository()
+	if repository.Name == "" {
+		return ErrEmptyRepoName
+	}
+	if repository.Organization == "" {
+		return ErrEmptyRepoOrganization
 	}
-	fmt.Fprintln(logWriter, "Checkout..")
 
-	checkout_dir := path.Join("checkout", shortSha)
+	if _, ok := allowedPushersSet[event.Sender.Login]; !ok {
+		log.Printf("Ignoring %q, not allowed", event.Sender.Login)
+		return ErrUserNotAllowed
+	}
 
-	// Checkout the target sha
-	err = gitCheckout(git_dir, checkout_dir, event.After)
-	if err != nil {
+	ref := "refs/tags/" + event.Ref
+	gh_repo := path.Join(repository.Organization, repository.Name)
+	if !tangConfig.Repo(gh_repo).BuildsRef(ref) {
+		log.Printf("Ignoring tag %v %v, excluded by config", gh_repo, ref)
 		return
 	}
 
-	log.Println("Created", checkout_dir)
+	log.Println("Tag", event.Ref, "created on", repository.Url)
 
-	// TODO(pwaller): One day this will have more information, e.g, QA link.
-	infoURL := "http://services.scraperwiki.com/tang/" + logPath
+	return submitBuild(&Build{BuildRecord: BuildRecord{
+		Repository: repository,
+		Ref:        ref,
+		Checkout:   ref,
+		Pusher:     Pusher{Name: event.Sender.Login},
+		Event:      "create",
+	}})
+}
 
-	// Set the state of the commit to "in progress" (seen as yellow in
-	// a github pull request)
-	status := GithubStatus{"pending", infoURL, "Running"}
-	updateStatus(gh_repo, event.After, status)
+// Invoked when a release is published. Its tag is built, with the name of
+// the release in TANG_RELEASE_NAME. With -release-admins, repository admins
+// can publish releases which get built even if they aren't allowed pushers.
+func eventRelease(event ReleaseEvent) (err error) {
+	repository := event.Repository.Repository()
+	if repository.Name == "" {
+		return ErrEmptyRepoName
+	}
+	if repository.Organization == "" {
+		return ErrEmptyRepoOrganization
+	}
 
-	// Run the tang script for the repository, if there is one.
-	repo_workdir := path.Join(git_dir, checkout_dir)
-	err = runTang(gh_repo, repo_workdir, logWriter, event)
+	gh_repo := path.Join(repository.Organization, repository.Name)
+	who := event.Sender.Login
+	if _, ok := allowedPushersSet[who]; !ok {
+		if !*releaseAdmins || !isRepoAdmin(gh_repo, who) {
+			log.Printf("Ignoring release by %q, not allowed", who)
+			return ErrUserNotAllowed
+		}
+		log.Printf("Building release by %q, an admin of %v", who, gh_repo)
+	}
 
-	if err == nil {
-		// All OK, send along a green
-		s := GithubStatus{"success", infoURL, "Tests passed"}
-		updateStatus(gh_repo, event.After, s)
+	ref := "refs/tags/" + event.Release.TagName
+	if !tangConfig.Repo(gh_repo).BuildsRef(ref) {
+		log.Printf("Ignoring release %v %v, excluded by config", gh_repo, ref)
 		return
 	}
 
-	// Not OK, send along red.
-	s := GithubStatus{"failure", infoURL, err.Error()}
-	updateStatus(gh_repo, event.After, s)
-	return
+	name := event.Release.Name
+	if name == "" {
+		name = event.Release.TagName
+	}
+	log.Println("Release", name, "published on", repository.Url)
+
+	return submitBuild(&Build{BuildRecord: BuildRecord{
+		Repository: repository,
+		Ref:        ref,
+		Checkout:   ref,
+		Pusher:     Pusher{Name: who},
+		Event:      "release",
+		Release:    name,
+	}})
 }
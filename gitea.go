@@ -0,0 +1,156 @@
+package main
+
+// Webhooks from gitea, and commit statuses sent back to it. Its payloads
+// are much like github's.
+// https://docs.gitea.com/usage/webhooks
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+type giteaProvider struct{}
+
+type giteaUser struct {
+	Login    string `json:"login"`
+	Username string `json:"username"`
+}
+
+func (u giteaUser) Name() string {
+	if u.Login != "" {
+		return u.Login
+	}
+	return u.Username
+}
+
+type giteaRepository struct {
+	FullName string `json:"full_name"`
+	CloneUrl string `json:"clone_url"`
+}
+
+func (r giteaRepository) Repository() Repository {
+	organization, name := splitRepoName(r.FullName)
+	return Repository{Name: name, Url: r.CloneUrl, Organization: organization,
+		Provider: "gitea"}
+}
+
+type giteaPushEvent struct {
+	Ref          string          `json:"ref"`
+	Before       string          `json:"before"`
+	After        string          `json:"after"`
+	Commits      []Commit        `json:"commits"`
+	TotalCommits int             `json:"total_commits"`
+	Repository   giteaRepository `json:"repository"`
+	Pusher       giteaUser       `json:"pusher"`
+	NonGithub    NonGithub       `json:"nongithub"`
+}
+
+type giteaPullRequestEvent struct {
+	Action      string `json:"action"`
+	Number      int    `json:"number"`
+	PullRequest struct {
+		Head PullRequestRef `json:"head"`
+		User giteaUser      `json:"user"`
+	} `json:"pull_request"`
+	Repository giteaRepository `json:"repository"`
+}
+
+func (giteaProvider) Name() string { return "gitea" }
+
+// Gitea is only listened to once tang can check its hooks, and send
+// statuses back. Until then its hooks look like github's.
+func (p giteaProvider) configured() bool {
+	return gitea_webhook_secret != "" && *giteaAPI != "" && gitea_token != ""
+}
+
+func (p giteaProvider) Detect(header http.Header) bool {
+	return p.configured() && header.Get("X-Gitea-Event") != ""
+}
+
+func (giteaProvider) EventType(header http.Header) string {
+	return header.Get("X-Gitea-Event")
+}
+
+// X-Gitea-Signature is the HMAC-SHA256 of the payload, in hex.
+func (p giteaProvider) Verify(header http.Header, body []byte) error {
+	if !p.configured() {
+		return ErrProviderNotConfigured
+	}
+	signature := header.Get("X-Gitea-Signature")
+	if signature == "" {
+		return ErrMissingToken
+	}
+	return checkHMAC(sha256.New, gitea_webhook_secret, body, signature)
+}
+
+func (giteaProvider) Handle(eventType string, document []byte) (err error) {
+	jsonLog.Println("Incoming gitea request:", string(document))
+
+	switch eventType {
+	case "push":
+		var event giteaPushEvent
+		err = json.Unmarshal(document, &event)
+		if err != nil {
+			return
+		}
+		if event.After == zeroSha {
+			// The branch or tag was deleted
+			return
+		}
+		return eventPush(PushEvent{
+			Ref:        event.Ref,
+			Repository: event.Repository.Repository(),
+			Before:     event.Before,
+			After:      event.After,
+			Commits:    pushCommits(event.Commits, event.TotalCommits),
+			Pusher:     Pusher{Name: event.Pusher.Name()},
+			NonGithub:  event.NonGithub,
+		})
+
+	case "pull_request":
+		var event giteaPullRequestEvent
+		err = json.Unmarshal(document, &event)
+		if err != nil {
+			return
+		}
+		switch event.Action {
+		case "opened", "synchronized", "reopened":
+		default:
+			log.Println("Ignoring pull request action:", event.Action)
+			return
+		}
+		pr := event.PullRequest
+		return submitPullRequest(&Build{BuildRecord: BuildRecord{
+			Repository:  event.Repository.Repository(),
+			Ref:         fmt.Sprintf("refs/pull/%d/head", event.Number),
+			Sha:         pr.Head.Sha,
+			Checkout:    pr.Head.Sha,
+			Pusher:      Pusher{Name: pr.User.Name()},
+			PullRequest: event.Number,
+		}}, event.Action)
+
+	default:
+		log.Println("Unhandled gitea event:", eventType)
+	}
+	return
+}
+
+// The same as github's statuses, at -gitea-api.
+func (giteaProvider) SendStatus(repo, sha string, s GithubStatus) bool {
+	if *giteaAPI == "" || gitea_token == "" {
+		log.Printf("-gitea-api or GITEA_TOKEN not specified, not sending status of %v %v",
+			repo, sha)
+		return true
+	}
+	endpoint := providerEndpoint(*giteaAPI, "repos", repo, "statuses", sha)
+	return postStatus("gitea", repo, sha, endpoint, s, func(req *http.Request) {
+		req.Header.Set("Authorization", "token "+gitea_token)
+	})
+}
+
+func (giteaProvider) Credentials(repo string) (username, password string, err error) {
+	return gitea_user, gitea_token, nil
+}
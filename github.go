@@ -0,0 +1,206 @@
+package main
+
+// A client for the github API which copes with github being flaky
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrSkipGithubEndpoint = errors.New("Github endpoint skipped")
+
+var githubClient = NewGithubClient()
+
+type GithubClient struct {
+	HTTP *http.Client
+
+	// 5xx responses, and network errors of idempotent requests, are retried
+	// this many times, after waiting Backoff, then twice that, and so on
+	// up to MaxBackoff.
+	Retries    int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// The longest to wait for the rate limit to reset, rather than fail
+	MaxRateLimitWait time.Duration
+
+	sleep func(time.Duration) // replaced in tests
+}
+
+func NewGithubClient() *GithubClient {
+	return &GithubClient{
+		HTTP:             &http.Client{Timeout: 30 * time.Second},
+		Retries:          5,
+		Backoff:          time.Second,
+		MaxBackoff:       time.Minute,
+		MaxRateLimitWait: 5 * time.Minute,
+		sleep:            time.Sleep,
+	}
+}
+
+// Make a request to `endpoint` (e.g, "repos", "scraperwiki/tang", "hooks"),
+// returning the body of the response. Responses other than network errors,
+// 5xx and running out of rate limit are returned as they are, it is up to
+// the caller to check the status code.
+func (c *GithubClient) Do(method, payload string, endpoint ...string) (respString string, resp *http.Response, err error) {
+	if githubApp == nil && github_token == "" && github_user == "" {
+		log.Printf("GITHUB_TOKEN not specified, not querying endpoint %q", endpoint)
+		err = ErrSkipGithubEndpoint
+		return
+	}
+
+	// Who the request is on behalf of, for a github App to find its
+	// installation, see githubCredentials()
+	var repo string
+	if len(endpoint) > 1 && (endpoint[0] == "repos" || endpoint[0] == "orgs") {
+		repo = endpoint[1]
+	}
+	return c.DoURL(method, Endpoint(endpoint...), payload, repo)
+}
+
+// Like Do, but for a whole URL, e.g from a Link header. `repo` is the
+// repository (or organization) the request is about.
+func (c *GithubClient) DoURL(method, url, payload, repo string) (respString string, resp *http.Response, err error) {
+	for attempt := 0; ; attempt++ {
+		var (
+			retry bool
+			wait  time.Duration
+		)
+		respString, resp, retry, wait, err = c.try(method, url, payload, repo)
+		if !retry {
+			return
+		}
+		if attempt == c.Retries {
+			if err == nil {
+				err = fmt.Errorf("%v %v: %v", method, url, resp.Status)
+			}
+			return
+		}
+		if wait == 0 {
+			wait = c.backoff(attempt)
+		}
+		if err != nil {
+			log.Printf("%v %v failed, retrying in %v: %v", method, url, wait, err)
+		} else {
+			log.Printf("%v %v got %v, retrying in %v", method, url, resp.Status, wait)
+		}
+		c.sleep(wait)
+	}
+}
+
+// One attempt at a request. `retry` is true if it is worth trying again,
+// after `wait` if github said how long.
+func (c *GithubClient) try(method, url, payload, repo string) (respString string, resp *http.Response, retry bool, wait time.Duration, err error) {
+	req, err := http.NewRequest(method, url, strings.NewReader(payload))
+	if err != nil {
+		return
+	}
+	if payload != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	err = setGithubAuth(req, repo)
+	if err != nil {
+		return
+	}
+
+	log.Println("Querying", method, url)
+	// Github might have got a request which failed on the way, so only
+	// those which can safely be made twice are retried.
+	resp, err = c.HTTP.Do(req)
+	if err != nil {
+		return "", nil, idempotent(method), 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", nil, idempotent(method), 0, err
+	}
+	respString = string(body)
+
+	remaining := resp.Header.Get("X-RateLimit-Remaining")
+	if remaining != "" {
+		log.Println("Rate Limit:", remaining)
+	}
+
+	switch {
+	case resp.StatusCode >= 500:
+		retry = true
+
+	case rateLimited(resp):
+		// Github did nothing with a request which was rate limited, so
+		// even a POST can be made again once the limit resets.
+		wait, err = c.rateLimitWait(resp)
+		retry = wait != 0
+	}
+	return
+}
+
+// Whether making a request with `method` twice does no more than making it
+// once. POSTs (e.g, statuses and check runs) are only retried when github
+// has said it didn't act on them, with a 5xx or because of the rate limit.
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "PUT", "PATCH", "DELETE":
+		return true
+	}
+	return false
+}
+
+// How long to wait before the retry after `attempt` failed attempts.
+func (c *GithubClient) backoff(attempt int) time.Duration {
+	wait := c.Backoff << uint(attempt)
+	if wait > c.MaxBackoff || wait <= 0 {
+		wait = c.MaxBackoff
+	}
+	return wait
+}
+
+// Whether github refused the request of `resp` because of the rate limit,
+// rather than because it isn't allowed.
+func rateLimited(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusForbidden:
+		return resp.Header.Get("Retry-After") != "" ||
+			resp.Header.Get("X-RateLimit-Remaining") == "0"
+	}
+	return false
+}
+
+// How long to wait for the rate limit to reset, zero if github didn't say.
+func (c *GithubClient) rateLimitWait(resp *http.Response) (wait time.Duration, err error) {
+	if after := resp.Header.Get("Retry-After"); after != "" {
+		// The secondary rate limit
+		seconds, _ := strconv.Atoi(after)
+		wait = time.Duration(seconds) * time.Second
+	} else if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		reset, _ := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+		wait = time.Until(time.Unix(reset, 0))
+	} else {
+		return 0, nil
+	}
+
+	if wait > c.MaxRateLimitWait {
+		return 0, fmt.Errorf("Rate limited for %v", wait)
+	}
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return wait, nil
+}
+
+func Github(payload string, endpoint ...string) (respString string, resp *http.Response, err error) {
+	return githubClient.Do("POST", payload, endpoint...)
+}
+
+func GithubGet(endpoint ...string) (respString string, resp *http.Response, err error) {
+	return githubClient.Do("GET", "", endpoint...)
+}
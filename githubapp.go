@@ -0,0 +1,171 @@
+package main
+
+// Authenticating as a github App, rather than as a person
+// http://developer.github.com/apps/building-github-apps/authenticating-with-github-apps/
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrBadAppKey = errors.New("Expected a PEM encoded RSA private key")
+
+// Set up in main(), nil unless -github-app-id is given
+var githubApp *GithubApp
+
+// Installation tokens are renewed when they have less than this left
+const tokenRenewBefore = 5 * time.Minute
+
+type GithubApp struct {
+	ID  int64
+	key *rsa.PrivateKey
+
+	client *http.Client
+
+	mu     sync.Mutex
+	tokens map[string]installationToken // keyed by repository owner
+}
+
+// http://developer.github.com/v3/apps/#create-a-new-installation-token
+type installationToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Load the App's private key, as downloaded from github.
+func LoadGithubApp(id int64, keyFile string) (*GithubApp, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrBadAppKey
+	}
+
+	var key *rsa.PrivateKey
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		var k interface{}
+		k, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err == nil {
+			var ok bool
+			if key, ok = k.(*rsa.PrivateKey); !ok {
+				err = ErrBadAppKey
+			}
+		}
+	default:
+		err = ErrBadAppKey
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", keyFile, err)
+	}
+
+	return &GithubApp{
+		ID:     id,
+		key:    key,
+		client: &http.Client{Timeout: 30 * time.Second},
+		tokens: map[string]installationToken{},
+	}, nil
+}
+
+// A JSON Web Token, signed with RS256, which identifies the App for the
+// next few minutes.
+func (app *GithubApp) JWT(now time.Time) (string, error) {
+	encode := base64.RawURLEncoding.EncodeToString
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]int64{
+		// A minute in the past, in case our clock is ahead of github's
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": app.ID,
+	})
+	unsigned := encode(header) + "." + encode(claims)
+
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, app.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + encode(signature), nil
+}
+
+// An installation token for `repo` (e.g, scraperwiki/tang, or scraperwiki
+// for the organization itself). Tokens are per installation, which is per
+// owner, and are reused until they are about to expire.
+func (app *GithubApp) Token(repo string) (string, error) {
+	owner := strings.SplitN(repo, "/", 2)[0]
+
+	app.mu.Lock()
+	defer app.mu.Unlock()
+
+	if t, ok := app.tokens[owner]; ok && time.Until(t.ExpiresAt) > tokenRenewBefore {
+		return t.Token, nil
+	}
+
+	jwt, err := app.JWT(time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	var installation struct {
+		ID int64 `json:"id"`
+	}
+	endpoint := Endpoint("repos", repo, "installation")
+	if !strings.Contains(repo, "/") {
+		// An organization, e.g for its hooks
+		endpoint = Endpoint("orgs", owner, "installation")
+	}
+	err = app.call("GET", endpoint, jwt, &installation)
+	if err != nil {
+		return "", fmt.Errorf("Finding installation for %v: %v", repo, err)
+	}
+
+	var t installationToken
+	endpoint = Endpoint("app", "installations", fmt.Sprint(installation.ID), "access_tokens")
+	err = app.call("POST", endpoint, jwt, &t)
+	if err != nil {
+		return "", fmt.Errorf("Getting token for %v: %v", owner, err)
+	}
+
+	app.tokens[owner] = t
+	return t.Token, nil
+}
+
+// Make a request authenticated as the App, decoding the response into `v`.
+func (app *GithubApp) call(method, url, jwt string, v interface{}) error {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	resp, err := app.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%v: %s", resp.Status, body)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
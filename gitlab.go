@@ -0,0 +1,167 @@
+package main
+
+// Webhooks from gitlab, and commit statuses sent back to it
+// https://docs.gitlab.com/ee/user/project/integrations/webhook_events.html
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+type gitlabProvider struct{}
+
+type gitlabProject struct {
+	PathWithNamespace string `json:"path_with_namespace"` // e.g "group/project"
+	GitHttpUrl        string `json:"git_http_url"`
+}
+
+func (p gitlabProject) Repository() Repository {
+	organization, name := splitRepoName(p.PathWithNamespace)
+	return Repository{Name: name, Url: p.GitHttpUrl, Organization: organization,
+		Provider: "gitlab"}
+}
+
+// "Push Hook" and "Tag Push Hook"
+type gitlabPushEvent struct {
+	Ref               string        `json:"ref"`
+	Before            string        `json:"before"`
+	After             string        `json:"after"`
+	UserUsername      string        `json:"user_username"`
+	Project           gitlabProject `json:"project"`
+	Commits           []Commit      `json:"commits"`
+	TotalCommitsCount int           `json:"total_commits_count"`
+	NonGithub         NonGithub     `json:"nongithub"`
+}
+
+// "Merge Request Hook", the project is the one being merged into.
+type gitlabMergeRequestEvent struct {
+	User struct {
+		Username string `json:"username"`
+	} `json:"user"`
+	Project          gitlabProject `json:"project"`
+	ObjectAttributes struct {
+		Iid        int    `json:"iid"`
+		Action     string `json:"action"`
+		OldRev     string `json:"oldrev"` // set when commits are pushed
+		LastCommit struct {
+			Id string `json:"id"`
+		} `json:"last_commit"`
+	} `json:"object_attributes"`
+}
+
+func (gitlabProvider) Name() string { return "gitlab" }
+
+// Gitlab is only listened to once tang can check its hooks, and send
+// statuses back.
+func (p gitlabProvider) configured() bool {
+	return gitlab_webhook_secret != "" && gitlab_token != ""
+}
+
+func (p gitlabProvider) Detect(header http.Header) bool {
+	return p.configured() && header.Get("X-Gitlab-Event") != ""
+}
+
+func (gitlabProvider) EventType(header http.Header) string {
+	return header.Get("X-Gitlab-Event")
+}
+
+// Gitlab sends the secret itself, rather than a signature.
+func (p gitlabProvider) Verify(header http.Header, body []byte) error {
+	if !p.configured() {
+		return ErrProviderNotConfigured
+	}
+	token := header.Get("X-Gitlab-Token")
+	if token == "" {
+		return ErrMissingToken
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(gitlab_webhook_secret)) != 1 {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+func (gitlabProvider) Handle(eventType string, document []byte) (err error) {
+	jsonLog.Println("Incoming gitlab request:", string(document))
+
+	switch eventType {
+	case "Push Hook", "Tag Push Hook":
+		var event gitlabPushEvent
+		err = json.Unmarshal(document, &event)
+		if err != nil {
+			return
+		}
+		if event.After == zeroSha {
+			// The branch or tag was deleted
+			return
+		}
+		return eventPush(PushEvent{
+			Ref:        event.Ref,
+			Repository: event.Project.Repository(),
+			Before:     event.Before,
+			After:      event.After,
+			Commits:    pushCommits(event.Commits, event.TotalCommitsCount),
+			Pusher:     Pusher{Name: event.UserUsername},
+			NonGithub:  event.NonGithub,
+		})
+
+	case "Merge Request Hook":
+		var event gitlabMergeRequestEvent
+		err = json.Unmarshal(document, &event)
+		if err != nil {
+			return
+		}
+		mr := event.ObjectAttributes
+		switch {
+		case mr.Action == "open", mr.Action == "reopen":
+		case mr.Action == "update" && mr.OldRev != "":
+		default:
+			log.Println("Ignoring merge request action:", mr.Action)
+			return
+		}
+		// Gitlab keeps the head of each merge request in the project being
+		// merged into, even if it comes from a fork.
+		return submitPullRequest(&Build{BuildRecord: BuildRecord{
+			Repository:  event.Project.Repository(),
+			Ref:         fmt.Sprintf("refs/merge-requests/%d/head", mr.Iid),
+			Sha:         mr.LastCommit.Id,
+			Checkout:    mr.LastCommit.Id,
+			Pusher:      Pusher{Name: event.User.Username},
+			PullRequest: mr.Iid,
+		}}, mr.Action)
+
+	default:
+		log.Println("Unhandled gitlab event:", eventType)
+	}
+	return
+}
+
+// https://docs.gitlab.com/ee/api/commits.html#set-the-pipeline-status-of-a-commit
+func (gitlabProvider) SendStatus(repo, sha string, s GithubStatus) bool {
+	if gitlab_token == "" {
+		log.Printf("GITLAB_TOKEN not specified, not sending status of %v %v", repo, sha)
+		return true
+	}
+	state := s.State
+	if state == "failure" || state == "error" {
+		state = "failed"
+	}
+	status := map[string]string{
+		"state":       state,
+		"target_url":  s.TargetUrl,
+		"description": s.Description,
+		"name":        s.Context,
+	}
+	endpoint := providerEndpoint(*gitlabAPI, "projects", url.PathEscape(repo), "statuses", sha)
+	return postStatus("gitlab", repo, sha, endpoint, status, func(req *http.Request) {
+		req.Header.Set("Private-Token", gitlab_token)
+	})
+}
+
+// Gitlab doesn't mind what the username is for an access token.
+func (gitlabProvider) Credentials(repo string) (username, password string, err error) {
+	return "oauth2", gitlab_token, nil
+}
@@ -0,0 +1,305 @@
+package main
+
+// Making sure github sends events for the repositories we care about to us,
+// and only to us
+// http://developer.github.com/v3/repos/hooks/
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The events tang asks github for
+var hookEvents = []string{"push", "issues", "issue_comment",
+	"commit_comment", "create", "delete",
+	"pull_request", "pull_request_review_comment",
+	"gollum", "watch", "release", "fork", "member",
+	"public", "team_add", "status"}
+
+// A hook as github describes it
+type githubHookInfo struct {
+	ID     int64            `json:"id"`
+	Name   string           `json:"name"`
+	Active bool             `json:"active"`
+	Events []string         `json:"events"`
+	Config GithubHookConfig `json:"config"`
+}
+
+// What tang remembers about the hooks it made, since github won't say what
+// a hook's secret is. Kept in the -hook-state file, keyed by repository.
+type hookState struct {
+	ID     int64  `json:"id"`
+	Url    string `json:"url"`
+	Secret string `json:"secret"` // fingerprint, see secretFingerprint()
+}
+
+// Set up github hooks so that it notifies us for any chances to repositories
+// we care about. Existing hooks which have drifted from what they should be
+// (e.g, a new -hook-url or GITHUB_WEBHOOK_SECRET) are updated. With
+// -prune-hooks, hooks tang made for repositories it no longer watches are
+// deleted. With -hooks-dry-run, the changes are only logged.
+//
+// The hooks are on each watched repository, or with -org-hook, on the
+// organization (whose name is used in place of a repository's).
+func configureHooks() {
+	repos, err := watchedRepositories()
+	if err != nil {
+		// Carry on without pruning everything
+		log.Printf("Not configuring hooks: %v", err)
+		return
+	}
+	targets := repos
+	if *organization != "" && *orgHook {
+		targets = []string{*organization}
+	}
+
+	state, err := loadHookState(*hookStateFile)
+	if err != nil {
+		log.Printf("Unable to read %v, starting afresh: %v", *hookStateFile, err)
+		state = map[string]hookState{}
+	}
+
+	configured := map[string]bool{}
+	for _, target := range targets {
+		configured[target] = true
+		err := reconcileHook(target, state)
+		if err != nil && err != ErrSkipGithubEndpoint {
+			log.Printf("Failed to configure hook for %v: %v", target, err)
+		}
+	}
+
+	if *pruneHooks {
+		for target, s := range state {
+			if configured[target] {
+				continue
+			}
+			log.Printf("Hooks: %v is no longer watched, deleting hook %v", target, s.ID)
+			if *hooksDryRun {
+				continue
+			}
+			// Forget the hook only once it is gone, so that it is tried
+			// again next time.
+			switch err := deleteHook(target, s.ID); {
+			case err == nil:
+				delete(state, target)
+			case err != ErrSkipGithubEndpoint:
+				log.Printf("Failed to delete hook %v of %v: %v", s.ID, target, err)
+			}
+		}
+	}
+
+	if *hooksDryRun {
+		return
+	}
+	err = saveHookState(*hookStateFile, state)
+	if err != nil {
+		log.Printf("Unable to save %v: %v", *hookStateFile, err)
+	}
+}
+
+// Make sure `repo` (or organization) has exactly one hook pointing at us, as
+// it should be.
+func reconcileHook(repo string, state map[string]hookState) error {
+	hooks, err := listHooks(repo)
+	if err != nil {
+		return err
+	}
+
+	want := GithubHook{
+		Name: "web",
+		Config: GithubHookConfig{
+			Url:         *hookURL,
+			ContentType: "json",
+			Secret:      github_webhook_secret,
+		},
+		Events: hookEvents,
+		Active: true,
+	}
+	fingerprint := secretFingerprint(github_webhook_secret)
+	known, haveState := state[repo]
+
+	// Ours are those at our URL, and the one we made before (which might
+	// have a different URL, if -hook-url changed).
+	var ours []githubHookInfo
+	for _, h := range hooks {
+		if h.Config.Url == *hookURL || (haveState && h.ID == known.ID) {
+			ours = append(ours, h)
+		}
+	}
+
+	if len(ours) == 0 {
+		log.Printf("Hooks: %v has no hook, creating one", repo)
+		if *hooksDryRun {
+			return nil
+		}
+		var created githubHookInfo
+		err = callHooks("POST", want, &created, hooksEndpoint(repo)...)
+		if err != nil {
+			return err
+		}
+		state[repo] = hookState{ID: created.ID, Url: *hookURL, Secret: fingerprint}
+		return nil
+	}
+
+	// Duplicates are left over from when 422 meant "already hooked".
+	for _, h := range ours[1:] {
+		log.Printf("Hooks: %v has a duplicate hook %v, deleting it", repo, h.ID)
+		if *hooksDryRun {
+			continue
+		}
+		err = deleteHook(repo, h.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	h := ours[0]
+	// Secrets are hidden by github, so we can only know whether it changed
+	// if we remember setting it.
+	secretDrift := !haveState || known.ID != h.ID || known.Secret != fingerprint
+	drift := hookDrift(h, want)
+	if secretDrift {
+		drift = append(drift, "secret")
+	}
+	if len(drift) == 0 {
+		log.Printf("Hooks: %v is up to date", repo)
+		return nil
+	}
+
+	log.Printf("Hooks: updating %v of hook %v on %v", strings.Join(drift, ", "), h.ID, repo)
+	if *hooksDryRun {
+		return nil
+	}
+	err = callHooks("PATCH", want, nil, hookEndpoint(repo, h.ID)...)
+	if err != nil {
+		return err
+	}
+	state[repo] = hookState{ID: h.ID, Url: *hookURL, Secret: fingerprint}
+	return nil
+}
+
+// The ways in which `h` differs from `want`, other than its secret.
+func hookDrift(h githubHookInfo, want GithubHook) (drift []string) {
+	if h.Config.Url != want.Config.Url {
+		drift = append(drift, "url")
+	}
+	if h.Config.ContentType != want.Config.ContentType {
+		drift = append(drift, "content type")
+	}
+	if !h.Active {
+		drift = append(drift, "active")
+	}
+	have := append([]string(nil), h.Events...)
+	sort.Strings(have)
+	events := append([]string(nil), want.Events...)
+	sort.Strings(events)
+	if strings.Join(have, " ") != strings.Join(events, " ") {
+		drift = append(drift, "events")
+	}
+	return
+}
+
+// repos/<owner>/<name>/hooks, or orgs/<org>/hooks for an organization.
+func hooksEndpoint(repo string) []string {
+	if strings.Contains(repo, "/") {
+		return []string{"repos", repo, "hooks"}
+	}
+	return []string{"orgs", repo, "hooks"}
+}
+
+func hookEndpoint(repo string, id int64) []string {
+	return append(hooksEndpoint(repo), strconv.FormatInt(id, 10))
+}
+
+func listHooks(repo string) (hooks []githubHookInfo, err error) {
+	endpoint := hooksEndpoint(repo)
+	endpoint[2] += "?per_page=100"
+	err = callHooks("GET", nil, &hooks, endpoint...)
+	return
+}
+
+// Delete hook `id` of `repo`. It is no error if it was already gone, e.g,
+// deleted by hand, or the repository with it.
+func deleteHook(repo string, id int64) error {
+	endpoint := hookEndpoint(repo, id)
+	response, resp, err := githubClient.Do("DELETE", "", endpoint...)
+	switch {
+	case err != nil:
+		return err
+	case resp.StatusCode == http.StatusNotFound:
+		log.Printf("Hooks: hook %v of %v was already gone", id, repo)
+	case resp.StatusCode/100 != 2:
+		return fmt.Errorf("DELETE %v: %v %v", strings.Join(endpoint, "/"),
+			resp.Status, response)
+	}
+	return nil
+}
+
+// Make a request of the hooks API, sending `payload` and decoding the
+// response into `result`, if they aren't nil.
+func callHooks(method string, payload, result interface{}, endpoint ...string) error {
+	var body []byte
+	if payload != nil {
+		var err error
+		body, err = json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+	}
+	response, resp, err := githubClient.Do(method, string(body), endpoint...)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%v %v: %v %v", method, strings.Join(endpoint, "/"),
+			resp.Status, response)
+	}
+	if result != nil && resp.StatusCode != http.StatusNoContent {
+		return json.Unmarshal([]byte(response), result)
+	}
+	return nil
+}
+
+// Something to tell whether the secret has changed by, without keeping it.
+func secretFingerprint(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte("tang hook secret\x00" + secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func loadHookState(filename string) (state map[string]hookState, err error) {
+	state = map[string]hookState{}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &state)
+	return
+}
+
+func saveHookState(filename string, state map[string]hookState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	err = ioutil.WriteFile(tmp, append(data, '\n'), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
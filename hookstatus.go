@@ -0,0 +1,113 @@
+package main
+
+// Statuses which tang.hook reports for contexts of its own, e.g tang/qa
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// The github status contexts tang uses itself
+const (
+	BuildContext  = "tang/build"
+	DeployContext = "tang/deploy"
+)
+
+// Github refuses longer contexts
+const maxStatusContext = 100
+
+// How often the hook's status file is read while it runs
+const hookStatusPoll = 2 * time.Second
+
+// tang.hook reports a status by appending a line to $TANG_STATUS_FILE:
+//
+//	<context> <state> [<target url>] <description>
+//
+// e.g, "tang/qa success https://qa.example.com/ QA site is up". The state is
+// one of pending, success, failure or error. Without a target URL, the
+// status links to the build's log. The file is read every few seconds while
+// the hook runs, and once more when it exits.
+type hookStatusFile struct {
+	filename string
+	offset   int64
+	partial  string // an incomplete last line, still being written
+}
+
+// Read the lines added to the file since last time, and send them on as
+// statuses of the build's commit. Bad lines are complained about in the log.
+// The last time, when the hook has exited, a line needn't end in a newline.
+func (f *hookStatusFile) forward(b *Build, infoURL string, logW io.Writer, last bool) {
+	fd, err := os.Open(f.filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Fprintln(logW, "Unable to read statuses:", err)
+		}
+		return
+	}
+	defer fd.Close()
+
+	_, err = fd.Seek(f.offset, io.SeekStart)
+	if err != nil {
+		return
+	}
+	data, err := ioutil.ReadAll(fd)
+	if err != nil {
+		fmt.Fprintln(logW, "Unable to read statuses:", err)
+	}
+	f.offset += int64(len(data))
+
+	text := f.partial + string(data)
+	if last {
+		text += "\n"
+	}
+	lines := strings.Split(text, "\n")
+	f.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		s, err := parseHookStatus(line, b.context())
+		if err != nil {
+			fmt.Fprintf(logW, "Ignoring status %q: %v\n", line, err)
+			continue
+		}
+		if s.TargetUrl == "" {
+			s.TargetUrl = infoURL
+		}
+		fmt.Fprintf(logW, "Reporting %v %v: %v\n", s.Context, s.State, s.Description)
+		b.forward(s)
+	}
+}
+
+// Parse a line written to $TANG_STATUS_FILE. The hook may not report the
+// build's own context, `ours`, tang does that.
+func parseHookStatus(line, ours string) (s GithubStatus, err error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return s, fmt.Errorf("expected <context> <state> [<url>] <description>")
+	}
+	s.Context, s.State = fields[0], fields[1]
+	fields = fields[2:]
+	if len(fields) > 0 && (strings.HasPrefix(fields[0], "http://") ||
+		strings.HasPrefix(fields[0], "https://")) {
+		s.TargetUrl, fields = fields[0], fields[1:]
+	}
+	s.Description = strings.Join(fields, " ")
+
+	switch {
+	case s.Context == ours:
+		return s, fmt.Errorf("%v is reported by tang", ours)
+	case len(s.Context) > maxStatusContext:
+		return s, fmt.Errorf("context longer than %d characters", maxStatusContext)
+	}
+	switch s.State {
+	case "pending", "success", "failure", "error":
+	default:
+		return s, fmt.Errorf("bad state %q", s.State)
+	}
+	return s, nil
+}
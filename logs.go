@@ -0,0 +1,200 @@
+package main
+
+// Code for following the logs of running builds
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/dustin/go-follow"
+)
+
+// Copy the log at `logPath` to `w` from `offset` onwards. If `done` is not
+// nil the build is still running, so keep following the log as it grows
+// until `done` is closed. Gives up early if `stop` is closed. Returns the
+// number of bytes copied.
+func followBuildLog(logPath string, offset int64, done, stop <-chan struct{},
+	w io.Writer) (n int64, err error) {
+
+	if done != nil {
+		n, err = followUntil(logPath, offset, done, stop, w)
+		if err != nil {
+			return
+		}
+		select {
+		case <-stop:
+			return
+		default:
+		}
+	}
+
+	// The build has finished, so whatever is left is all there is.
+	fd, err := os.Open(logPath)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+
+	_, err = fd.Seek(offset+n, os.SEEK_SET)
+	if err != nil {
+		return
+	}
+	m, err := io.Copy(w, fd)
+	n += m
+	return
+}
+
+// Follow the log until either `done` or `stop` is closed. Some of the log
+// may be left unread, since the follower is stopped as soon as the build is
+// done.
+func followUntil(logPath string, offset int64, done, stop <-chan struct{},
+	w io.Writer) (n int64, err error) {
+
+	stationaryFd, err := os.Open(logPath)
+	if err != nil {
+		return
+	}
+	defer stationaryFd.Close()
+
+	_, err = stationaryFd.Seek(offset, os.SEEK_SET)
+	if err != nil {
+		return
+	}
+	fd := follow.New(stationaryFd)
+
+	copied := make(chan error, 1)
+	go func() {
+		var err error
+		n, err = io.Copy(w, fd)
+		copied <- err
+	}()
+
+	select {
+	case err = <-copied:
+		// The writer failed
+		return
+	case <-done:
+	case <-stop:
+	}
+
+	// Close the follow descriptor, causes Copy to terminate
+	_ = fd.Close()
+	<-copied
+	return
+}
+
+// Server-Sent Events handler for /tang/sse/logs/<build id>, for browsers
+// without websockets, and `curl -N`. Each line of the log is an event whose
+// id is the byte offset of the end of the line, so that a client which
+// reconnects with Last-Event-ID carries on where it left off. When the build
+// has finished, a "status" event carries the build as JSON.
+func SSELogHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/tang/sse/logs/")
+	record, ok := buildStore.Get(id)
+	if !ok || record.LogPath == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	var offset int64
+	if lastID := r.Header.Get("Last-Event-ID"); lastID != "" {
+		var err error
+		offset, err = strconv.ParseInt(lastID, 10, 64)
+		if err != nil || offset < 0 {
+			http.Error(w, "Bad Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var done <-chan struct{}
+	if b := buildQueue.Lookup(id); b != nil {
+		done = b.done
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stop nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	stop := r.Context().Done()
+	events := &sseLineWriter{w: w, flusher: flusher, offset: offset}
+
+	_, err := followBuildLog(record.LogPath, offset, done, stop, events)
+	if err != nil {
+		log.Println("SSELogHandler():", err)
+		return
+	}
+	select {
+	case <-stop:
+		return
+	default:
+	}
+	// A last line with no newline
+	events.flushPartial()
+
+	record, _ = buildStore.Get(id)
+	final, err := json.Marshal(record)
+	if err != nil {
+		log.Println("SSELogHandler():", err)
+		return
+	}
+	fmt.Fprintf(w, "event: status\nid: %d\ndata: %s\n\n", events.offset, final)
+	flusher.Flush()
+}
+
+// Turns what is written to it into one event per line.
+type sseLineWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+	offset  int64 // of the end of the last line sent
+	partial []byte
+}
+
+func (s *sseLineWriter) Write(data []byte) (n int, err error) {
+	s.partial = append(s.partial, data...)
+	for {
+		i := bytes.IndexByte(s.partial, '\n')
+		if i < 0 {
+			break
+		}
+		err = s.event(s.partial[:i], int64(i+1))
+		if err != nil {
+			return
+		}
+		s.partial = s.partial[i+1:]
+	}
+	s.flusher.Flush()
+	return len(data), nil
+}
+
+func (s *sseLineWriter) flushPartial() {
+	if len(s.partial) == 0 {
+		return
+	}
+	s.event(s.partial, int64(len(s.partial)))
+	s.partial = nil
+	s.flusher.Flush()
+}
+
+// Send one line, which accounts for `length` bytes of the log.
+func (s *sseLineWriter) event(line []byte, length int64) (err error) {
+	s.offset += length
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	_, err = fmt.Fprintf(s.w, "id: %d\ndata: %s\n\n", s.offset, line)
+	return
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
@@ -12,22 +13,60 @@ import (
 	"os/exec"
 	"os/signal"
 	"path"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"syscall"
 	"time"
 
-	"github.com/dustin/go-follow"
 	"github.com/gorilla/websocket"
 )
 
 var (
 	address        = flag.String("address", ":8080", "address to listen on")
 	repositories   = flag.String("repositories", "scraperwiki/tang", "colon separated list of repositories to watch")
+	organization   = flag.String("organization", "", "watch the repositories of this github organization, instead of -repositories")
+	orgHook        = flag.Bool("org-hook", false, "with -organization, use one hook on the organization rather than one on each repository")
+	orgRefresh     = flag.Duration("org-refresh", time.Hour, "how often to look for new repositories in -organization")
 	allowedPushers = flag.String("allowed-pushers", "drj11:pwaller", "list of people allowed")
 	uid            = flag.Int("uid", 0, "uid to run as")
-
-	github_user, github_password string
+	workers        = flag.Int("workers", 2, "number of builds to run at once")
+	queueSize      = flag.Int("queue-size", 100, "maximum number of builds waiting to run")
+	buildsFile     = flag.String("builds", "builds.json", "file to keep the history of builds in")
+	outboxFile     = flag.String("status-outbox", "statuses.json", "file to keep statuses which haven't been sent to github yet in")
+	configFile     = flag.String("config", "", "JSON file of per-repository settings")
+	supersede      = flag.Bool("supersede", true, "cancel builds of a ref when a newer commit is pushed to it")
+	hookTimeout    = flag.Duration("hook-timeout", time.Hour, "how long tang.hook may run for, 0 for no limit")
+	killGrace      = flag.Duration("kill-grace", 10*time.Second, "time between SIGTERM and SIGKILL when stopping tang.hook")
+	buildPRMerge   = flag.Bool("pr-merge", false, "build the merge of a pull request into its base rather than its head")
+	githubAPI      = flag.String("github-api", "https://api.github.com/", "github API base URL, e.g https://github.example.com/api/v3/ for github enterprise")
+	hookURL        = flag.String("hook-url", "http://services.scraperwiki.com/hook", "public URL of /hook, which github is told to send events to")
+	publicURL      = flag.String("public-url", "http://services.scraperwiki.com/tang/", "public URL of tang's pages, which statuses link to")
+	hookStateFile  = flag.String("hook-state", "hooks.json", "file to remember the github hooks tang made in")
+	pruneHooks     = flag.Bool("prune-hooks", false, "delete the hooks tang made for repositories no longer in -repositories")
+	hooksDryRun    = flag.Bool("hooks-dry-run", false, "only log the changes which would be made to github hooks")
+	githubAppID    = flag.Int64("github-app-id", 0, "authenticate as this github App, rather than with GITHUB_TOKEN")
+	githubAppKey   = flag.String("github-app-key", "github-app.pem", "the github App's private key")
+	useChecks      = flag.Bool("checks", false, "report builds as github check runs too, with annotations (needs -github-app-id)")
+	releaseAdmins  = flag.Bool("release-admins", false, "build releases published by repository admins who aren't allowed pushers")
+	gitlabAPI      = flag.String("gitlab-api", "https://gitlab.com/api/v4/", "gitlab API base URL, for statuses of repositories on gitlab")
+	giteaAPI       = flag.String("gitea-api", "", "gitea API base URL, e.g https://gitea.example.com/api/v1/")
+	bitbucketAPI   = flag.String("bitbucket-api", "https://api.bitbucket.org/2.0/", "bitbucket API base URL")
+
+	// Credentials for github, see setGithubAuth()
+	github_token, github_user, github_password string
+
+	// Shared secret used to sign webhook payloads, see checkSignature()
+	github_webhook_secret string
+
+	// The same for the other providers, see Provider
+	gitlab_token, gitlab_webhook_secret                          string
+	gitea_user, gitea_token, gitea_webhook_secret                string
+	bitbucket_user, bitbucket_password, bitbucket_webhook_secret string
+
+	// The environment variables the above came from, which tang.hook doesn't
+	// get to see, but tang does when it restarts.
+	credentialEnv []string
 
 	allowedPushersSet = map[string]bool{}
 
@@ -40,12 +79,24 @@ func init() {
 	for _, who := range strings.Split(*allowedPushers, ":") {
 		allowedPushersSet[who] = true
 	}
+	github_token = os.Getenv("GITHUB_TOKEN")
 	github_user = os.Getenv("GITHUB_USER")
 	github_password = os.Getenv("GITHUB_PASSWORD")
+	github_webhook_secret = os.Getenv("GITHUB_WEBHOOK_SECRET")
+	gitlab_token = os.Getenv("GITLAB_TOKEN")
+	gitlab_webhook_secret = os.Getenv("GITLAB_WEBHOOK_SECRET")
+	gitea_user = os.Getenv("GITEA_USER")
+	gitea_token = os.Getenv("GITEA_TOKEN")
+	gitea_webhook_secret = os.Getenv("GITEA_WEBHOOK_SECRET")
+	bitbucket_user = os.Getenv("BITBUCKET_USER")
+	bitbucket_password = os.Getenv("BITBUCKET_APP_PASSWORD")
+	bitbucket_webhook_secret = os.Getenv("BITBUCKET_WEBHOOK_SECRET")
 	env := os.Environ()
 	os.Clearenv()
 	for _, e := range env {
-		if strings.HasPrefix(e, "GITHUB_") {
+		if strings.HasPrefix(e, "GITHUB_") || strings.HasPrefix(e, "GITLAB_") ||
+			strings.HasPrefix(e, "GITEA_") || strings.HasPrefix(e, "BITBUCKET_") {
+			credentialEnv = append(credentialEnv, e)
 			continue
 		}
 		split := strings.SplitN(e, "=", 2)
@@ -60,6 +111,11 @@ func check(err error) {
 	}
 }
 
+// The public URL of `page` (e.g, a build's log) under -public-url.
+func tangURL(page string) string {
+	return strings.TrimSuffix(*publicURL, "/") + "/" + page
+}
+
 func ensureChildDeath() {
 	sid, err := syscall.Setsid()
 	if err != nil {
@@ -109,8 +165,19 @@ func main() {
 		check(err)
 	}
 
-	err = gitSetupCredentialHelper()
-	check(err)
+	if *useChecks && *githubAppID == 0 {
+		log.Fatal("-checks needs -github-app-id, only github Apps can make check runs")
+	}
+	if *githubAppID != 0 {
+		githubApp, err = LoadGithubApp(*githubAppID, *githubAppKey)
+		check(err)
+	} else if github_token == "" && github_user != "" {
+		log.Println("GITHUB_USER and GITHUB_PASSWORD are deprecated, use GITHUB_TOKEN")
+	}
+
+	if github_webhook_secret == "" {
+		log.Println("GITHUB_WEBHOOK_SECRET not set, /hook signatures will not be verified!")
+	}
 
 	// Start catching signals early.
 	sig := make(chan os.Signal)
@@ -120,17 +187,41 @@ func main() {
 	err = os.MkdirAll("logs/", 0777)
 	check(err)
 
+	if *configFile != "" {
+		tangConfig, err = loadConfig(*configFile)
+		check(err)
+	}
+
+	buildStore, err = OpenBuildStore(*buildsFile)
+	check(err)
+
+	statusOutbox, err = OpenStatusOutbox(*outboxFile)
+	check(err)
+	reportInterrupted(buildStore)
+	go statusOutbox.Run()
+
+	buildQueue = NewBuildQueue(*queueSize)
+	buildQueue.Start(*workers)
+
 	go ServeHTTP(listener)
 
 	// Set up github hooks
 	configureHooks()
+	if *organization != "" {
+		// Repositories come and go
+		go func() {
+			for range time.Tick(*orgRefresh) {
+				configureHooks()
+			}
+		}()
+	}
 
 	go func() {
 		// Hack to let github know that the process started successfully
 		// (Since the previous one may have been killed)
-		infoURL := "http://services.scraperwiki.com/tang/"
-		s := GithubStatus{"success", infoURL, "Tang running"}
-		updateStatus("scraperwiki/tang", tangRev, s)
+		s := GithubStatus{State: "success", TargetUrl: tangURL(""),
+			Description: "Tang running", Context: DeployContext}
+		updateStatus("github", "scraperwiki/tang", tangRev, s)
 	}()
 
 	// Tell the user how to quit
@@ -147,6 +238,9 @@ func main() {
 
 	log.Printf("Received %v", value)
 
+	// Hooks don't outlive the tang which started them
+	stopHooks()
+
 	if value == syscall.SIGTERM {
 		return
 	}
@@ -161,53 +255,11 @@ func main() {
 	// This is probably very tricky to get right without delaying the exec.
 	// How do we find our children? Might involve iterating through /proc.
 
-	err = syscall.Exec(exe, os.Args, gitCredentialsEnviron())
+	env := append(os.Environ(), credentialEnv...)
+	err = syscall.Exec(exe, os.Args, env)
 	check(err)
 }
 
-// Set up github hooks so that it notifies us for any chances to repositories
-// we care about
-func configureHooks() {
-
-	if *repositories == "" {
-		return
-	}
-
-	// JSON payload for github
-	// http://developer.github.com/v3/repos/hooks/#json-http
-	json := `{
-	"name": "web",
-	"config": {"url": "http://services.scraperwiki.com/hook",
-		"content_type": "json"},
-	"events": ["push", "issues", "issue_comment",
-		"commit_comment", "create", "delete",
-		"pull_request", "pull_request_review_comment",
-		"gollum", "watch", "release", "fork", "member",
-		"public", "team_add", "status"],
-	"active": true
-	}`
-
-	// Each of the repositories listed on the command line
-	repos := strings.Split(*repositories, ":")
-
-	for _, repo := range repos {
-		response, resp, err := Github(json, "repos", repo, "hooks")
-		if err == ErrSkipGithubEndpoint {
-			continue
-		}
-		check(err)
-
-		switch resp.StatusCode {
-		default:
-			log.Print(response)
-
-		case 422:
-			log.Println("Already hooked for", repo)
-		}
-	}
-
-}
-
 // Since CTRL-C is used for a reload, it's nice to have a way to exit (CTRL-D).
 func ExitOnEOF() {
 	func() {
@@ -234,10 +286,24 @@ func (ww *WebsocketWriter) Write(data []byte) (n int, err error) {
 	return
 }
 
+// Websocket handler for /tang/live/logs/<build id>. Sends the build's log so
+// far, then new output as it arrives. Once the build has finished, a final
+// text message carries the build's record as JSON and the socket is closed.
 func LiveLogHandler(response http.ResponseWriter, req *http.Request) {
-	ws, err := websocket.Upgrade(response, req, nil, 1024, 1024)
-	defer ws.Close()
+	id := strings.TrimPrefix(req.URL.Path, "/tang/live/logs/")
+	record, ok := buildStore.Get(id)
+	if !ok || record.LogPath == "" {
+		http.NotFound(response, req)
+		return
+	}
+
+	// Only running builds need following
+	var done <-chan struct{}
+	if b := buildQueue.Lookup(id); b != nil {
+		done = b.done
+	}
 
+	ws, err := websocket.Upgrade(response, req, nil, 1024, 1024)
 	if _, ok := err.(websocket.HandshakeError); ok {
 		http.Error(response, "Not a websocket handshake", 400)
 		return
@@ -245,29 +311,45 @@ func LiveLogHandler(response http.ResponseWriter, req *http.Request) {
 		log.Println(err)
 		return
 	}
+	defer ws.Close()
 
-	stationaryFd, err := os.Open("/home/pwaller/test.log")
-	check(err)
-	defer stationaryFd.Close()
-	fd := follow.New(stationaryFd)
-
+	stop := make(chan struct{})
 	go func() {
-		var err error
 		// Wait until the other end closes the connection or sends
 		// a message.
-		t, m, err := ws.ReadMessage()
+		_, _, err := ws.ReadMessage()
 		if err != io.EOF && err != io.ErrUnexpectedEOF {
 			log.Println("LiveLogHandler(): error reading msg: ", err)
 		}
-		_, _ = t, m
-		// Close the follow descripter, causes Copy to terminate
-		_ = fd.Close()
+		close(stop)
 	}()
 
 	w := &WebsocketWriter{ws}
-	// Blocks until web connection is closed.
-	_, err = io.Copy(w, fd)
-	// log.Println("Err =", err, n)
+	// Blocks until the build is finished or the web connection is closed.
+	_, err = followBuildLog(record.LogPath, 0, done, stop, w)
+	if err != nil {
+		log.Println("LiveLogHandler():", err)
+		return
+	}
+
+	select {
+	case <-stop:
+		return
+	default:
+	}
+
+	record, _ = buildStore.Get(id)
+	final, err := json.Marshal(record)
+	if err != nil {
+		log.Println("LiveLogHandler():", err)
+		return
+	}
+	err = ws.WriteMessage(websocket.TextMessage, final)
+	if err != nil {
+		return
+	}
+	ws.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, record.State))
 }
 
 func ServeHTTP(l net.Listener) {
@@ -276,14 +358,17 @@ func ServeHTTP(l net.Listener) {
 	check(err)
 	logDir := path.Join(pwd, "logs")
 
-	logHandler := http.FileServer(http.Dir(logDir))
+	logHandler := LogHandler(logDir)
 
 	log.Println("Serving logs at", logDir)
 
 	handler := NewTangHandler()
 
 	handler.HandleFunc("/tang/", handleTang)
+	handler.HandleFunc("/tang/queue", handleQueue)
+	handler.HandleFunc("/tang/api/", handleAPI)
 	handler.HandleFunc("/tang/live/logs/", LiveLogHandler)
+	handler.HandleFunc("/tang/sse/logs/", SSELogHandler)
 	handler.Handle("/tang/logs/", http.StripPrefix("/tang/logs/", logHandler))
 	handler.HandleFunc("/hook", handleHook)
 
@@ -291,6 +376,61 @@ func ServeHTTP(l net.Listener) {
 	log.Fatal(err)
 }
 
+// Logs used to live at logs/<short sha>/log.txt, so keep those URLs working
+// by redirecting them to the most recent build of a matching sha.
+var oldLogPath = regexp.MustCompile(`^/?([0-9a-f]{6})/log.txt$`)
+
+// Serves `logDir`, where paths are relative to it.
+func LogHandler(logDir string) http.Handler {
+	files := http.FileServer(http.Dir(logDir))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := oldLogPath.FindStringSubmatch(r.URL.Path)
+		if m == nil {
+			files.ServeHTTP(w, r)
+			return
+		}
+
+		// A log from before the layout changed
+		_, err := os.Stat(path.Join(logDir, r.URL.Path))
+		if err == nil {
+			files.ServeHTTP(w, r)
+			return
+		}
+
+		target, err := findLatestLog(logDir, m[1])
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, "/tang/logs/"+target, http.StatusFound)
+	})
+}
+
+// The path, relative to `logDir`, of the most recently written log for a
+// sha starting with `shortSha`.
+func findLatestLog(logDir, shortSha string) (logPath string, err error) {
+	pattern := path.Join(logDir, "*", "*", shortSha+"*", "*", "log.txt")
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return
+	}
+
+	var latest time.Time
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err != nil || info.ModTime().Before(latest) {
+			continue
+		}
+		latest = info.ModTime()
+		logPath = match
+	}
+	if logPath == "" {
+		return "", os.ErrNotExist
+	}
+	return filepath.Rel(logDir, logPath)
+}
+
 type TangHandler struct {
 	*http.ServeMux
 	requests chan<- Request
@@ -341,17 +481,18 @@ func (th *TangHandler) HandleQA(w http.ResponseWriter, r *http.Request) (handled
 	return
 }
 
-func handleTang(w http.ResponseWriter, r *http.Request) {
-	w.Header()["Content-Type"] = []string{"text/plain; charset=utf-8"}
-	w.WriteHeader(http.StatusOK)
-
-	fmt.Fprintf(w, `<!DOCTYPE html><style>html, body { font-type: sans; }</style><pre id="content"><pre>`)
+// Plain text list of what is running and what is waiting to run.
+func handleQueue(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 
-	for i := 0; i < 100; i++ {
-		fmt.Fprintf(w, "%d elephants\n", i)
-		w.(http.Flusher).Flush()
-		time.Sleep(100 * time.Millisecond)
+	running, pending := buildQueue.Snapshot()
+	fmt.Fprintf(w, "%d running, %d waiting\n\n", len(running), len(pending))
+	for _, b := range running {
+		fmt.Fprintf(w, "running %v %v %v (started %v ago)\n", b.RepoName(),
+			b.Ref, b.Sha, time.Since(b.Started))
+	}
+	for _, b := range pending {
+		fmt.Fprintf(w, "waiting %v %v %v (queued %v ago)\n", b.RepoName(),
+			b.Ref, b.Sha, time.Since(b.Queued))
 	}
-
-	// fmt.Fprintf(w, `<script>window.location = "http://duckduckgo.com";</script>`)
 }
@@ -1,10 +1,32 @@
 package main
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/kr/text"
 )
 
@@ -15,11 +37,70 @@ func IndentLogger() func() {
 	}
 }
 
+// Stands in for the github API during tests, recording what tang asks of it
+var fakeGithub = &githubRecorder{}
+
+type recordedRequest struct {
+	Method, Path, Authorization string
+	Body                        []byte
+	Header                      http.Header
+}
+
+type githubRecorder struct {
+	mu       sync.Mutex
+	requests []recordedRequest
+}
+
+func (g *githubRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	g.mu.Lock()
+	g.requests = append(g.requests, recordedRequest{r.Method, r.URL.EscapedPath(),
+		r.Header.Get("Authorization"), body, r.Header})
+	g.mu.Unlock()
+
+	w.Header().Set("X-RateLimit-Remaining", "5000")
+	if r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/hooks") {
+		fmt.Fprintln(w, "[]")
+		return
+	}
+	if r.Method != "POST" {
+		fmt.Fprintln(w, "{}")
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintln(w, `{"id": 7}`)
+}
+
+// The requests made since the last call.
+func (g *githubRecorder) Take() []recordedRequest {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	requests := g.requests
+	g.requests = nil
+	return requests
+}
+
 func init() {
-	err := os.Setenv("TANG_TEST", "1")
+	*githubAPI = httptest.NewServer(fakeGithub).URL
+	github_token = "test-token"
+
+	dir, err := ioutil.TempDir("", "tang-test")
+	if err != nil {
+		panic(err)
+	}
+	buildStore, err = OpenBuildStore(path.Join(dir, "builds.json"))
 	if err != nil {
 		panic(err)
 	}
+
+	// Statuses are only sent when a test asks, see sentToGithub()
+	statusOutbox, err = OpenStatusOutbox(path.Join(dir, "statuses.json"))
+	if err != nil {
+		panic(err)
+	}
+
+	buildQueue = NewBuildQueue(10)
+	buildQueue.Start(1)
 }
 
 func TestTrivialRepo(t *testing.T) {
@@ -36,8 +117,9 @@ func TestTrivialRepo(t *testing.T) {
 			Organization: "example",
 			Url:          "fixture/trivial-repo",
 		},
-		After:  "96ad1ed5a4ca297259e833a831dd6a8f028cc75",
-		Pusher: Pusher{Name: "testuser"},
+		After:     "96ad1ed5a4ca297259e833a831dd6a8f028cc75",
+		Pusher:    Pusher{Name: "testuser"},
+		NonGithub: NonGithub{Wait: true},
 	}
 
 	allowedPushersSet["testuser"] = true
@@ -61,7 +143,7 @@ func TestPush(t *testing.T) {
 		},
 		After:     "ee7c7b8f65dea5d3ef81c17eacd1b873be167109",
 		Pusher:    Pusher{Name: "testuser"},
-		NonGithub: NonGithub{NoBuild: true},
+		NonGithub: NonGithub{NoBuild: true, Wait: true},
 	}
 
 	allowedPushersSet["testuser"] = true
@@ -84,7 +166,7 @@ func TestEvent(t *testing.T) {
 		"repository": {"name": "tang", "organization": "example", "url": "."},
 		"after": "ee7c7b8f65dea5d3ef81c17eacd1b873be167109",
 		"pusher": {"name":"testuser"},
-		"nongithub": {"nobuild": true}
+		"nongithub": {"nobuild": true, "wait": true}
 		}`))
 
 	if err != nil {
@@ -111,3 +193,2180 @@ func TestAccess(t *testing.T) {
 	}
 
 }
+
+func TestHookSignature(t *testing.T) {
+	defer IndentLogger()()
+
+	github_webhook_secret = "s3cret"
+	defer func() { github_webhook_secret = "" }()
+
+	payload := `{"zen": "Keep it logically awesome."}`
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(payload))
+	good := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	for signature, expected := range map[string]int{
+		"":                http.StatusUnauthorized,
+		"sha256=deadbeef": http.StatusUnauthorized,
+		"sha1=" + good:    http.StatusUnauthorized,
+		good:              http.StatusOK,
+	} {
+		r, err := http.NewRequest("POST", "/hook", strings.NewReader(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("X-Github-Event", "ping")
+		if signature != "" {
+			r.Header.Set("X-Hub-Signature-256", signature)
+		}
+
+		w := httptest.NewRecorder()
+		handleHook(w, r)
+		if w.Code != expected {
+			t.Errorf("signature %q: got %d, expected %d", signature, w.Code, expected)
+		}
+	}
+}
+
+func TestPullRequestEvent(t *testing.T) {
+	defer IndentLogger()()
+	defer inTempDir(t)()
+
+	allowedPushersSet["testuser"] = true
+	defer delete(allowedPushersSet, "testuser")
+
+	document := `{
+		"action": %q,
+		"number": 1,
+		"pull_request": {
+			"head": {"ref": "feature", "sha": "ee7c7b8f65dea5d3ef81c17eacd1b873be167109"},
+			"user": {"login": "testeviluser"}
+		},
+		"repository": {"name": "tang", "clone_url": ".", "owner": {"login": "example"}}
+		}`
+
+	err := handleEvent("pull_request", []byte(fmt.Sprintf(document, "closed")))
+	if err != nil {
+		t.Error("Closed pull request should be ignored: ", err)
+	}
+
+	err = handleEvent("pull_request", []byte(fmt.Sprintf(document, "opened")))
+	if err != ErrUserNotAllowed {
+		t.Error("Pull request author wasn't denied access! ", err)
+	}
+
+	// Pull requests by allowed users are built, first when opened, then
+	// when more commits are pushed to them.
+	resetGithub(t)
+	dir, opened := makeRepo(t, map[string]string{
+		"tang.hook": "#!/bin/sh\ntrue\n",
+	})
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(path.Join(dir, "README"), []byte("More\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := Command(dir, "sh", "-c", "git add README && git commit -q -m more && git rev-parse HEAD")
+	cmd.Stdout = nil
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=tang", "GIT_AUTHOR_EMAIL=tang@example.com",
+		"GIT_COMMITTER_NAME=tang", "GIT_COMMITTER_EMAIL=tang@example.com")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	synchronized := strings.TrimSpace(string(out))
+
+	document = `{
+		"action": %q,
+		"number": 2,
+		"pull_request": {
+			"head": {"ref": "feature", "sha": %q},
+			"user": {"login": "testuser"}
+		},
+		"repository": {"name": "pull-request", "clone_url": %q, "owner": {"login": "example"}}
+		}`
+	for _, c := range []struct{ action, sha string }{
+		{"opened", opened},
+		{"synchronize", synchronized},
+	} {
+		err = handleEvent("pull_request", []byte(fmt.Sprintf(document, c.action, c.sha, dir)))
+		if err != nil {
+			t.Fatalf("%v: %v", c.action, err)
+		}
+
+		// Pull requests from github aren't waited for
+		var r BuildRecord
+		for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(10 * time.Millisecond) {
+			r = buildStore.List()[0]
+			if r.Sha == c.sha && r.State != StateQueued && r.State != StateRunning {
+				break
+			}
+		}
+		if r.Sha != c.sha || r.Ref != "refs/pull/2/head" || r.PullRequest != 2 ||
+			r.State != StateSuccess {
+			t.Errorf("%v: unexpected build of %v %v: %v %v", c.action, r.Ref, r.Sha,
+				r.State, r.Error)
+		}
+
+		requests := sentToGithub(t)
+		if len(requests) != 1 {
+			t.Fatalf("%v: expected a status to be sent, got %v", c.action, requests)
+		}
+		var s GithubStatus
+		json.Unmarshal(requests[0].Body, &s)
+		if requests[0].Path != "/repos/example/pull-request/statuses/"+c.sha ||
+			s.State != "success" {
+			t.Errorf("%v: unexpected status %v %+v", c.action, requests[0].Path, s)
+		}
+	}
+}
+
+func TestProviders(t *testing.T) {
+	defer IndentLogger()()
+	defer inTempDir(t)()
+	resetGithub(t)
+
+	dir, sha := makeRepo(t, map[string]string{
+		"tang.hook": "#!/bin/sh\ntrue\n",
+	})
+	defer os.RemoveAll(dir)
+	// Bitbucket's clone URLs end in .git
+	err := os.Symlink(dir, dir+".git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(dir + ".git")
+
+	allowedPushersSet["testuser"] = true
+	defer delete(allowedPushersSet, "testuser")
+
+	defer func(gitlab, gitea, bitbucket string) {
+		*gitlabAPI, *giteaAPI, *bitbucketAPI = gitlab, gitea, bitbucket
+		gitlab_token, gitlab_webhook_secret = "", ""
+		gitea_user, gitea_token, gitea_webhook_secret = "", "", ""
+		bitbucket_user, bitbucket_password, bitbucket_webhook_secret = "", "", ""
+	}(*gitlabAPI, *giteaAPI, *bitbucketAPI)
+	*gitlabAPI = *githubAPI + "/gitlab/api/v4/"
+	*giteaAPI = *githubAPI + "/gitea/api/v1/"
+	*bitbucketAPI = *githubAPI + "/bitbucket/2.0/"
+	gitlab_token, gitlab_webhook_secret = "gl-token", "gl-secret"
+	gitea_user, gitea_token, gitea_webhook_secret = "tang", "gt-token", "gt-secret"
+	bitbucket_user, bitbucket_password, bitbucket_webhook_secret = "tang", "bb-password", "bb-secret"
+
+	sign := func(secret, body string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(body))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	post := func(body string, header ...string) int {
+		r, err := http.NewRequest("POST", "/hook", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		handleHook(w, r)
+		return w.Code
+	}
+
+	if code := post("{}"); code != http.StatusBadRequest {
+		t.Errorf("Expected a request from nowhere to be refused, got %d", code)
+	}
+
+	gitlab := fmt.Sprintf(`{"object_kind": "push", "ref": "refs/heads/master",
+		"before": %q, "after": %q, "user_username": "testuser",
+		"project": {"path_with_namespace": "example/sub/repo", "git_http_url": %q},
+		"commits": [], "total_commits_count": 1, "nongithub": {"wait": true}}`,
+		zeroSha, sha, dir)
+	gitea := fmt.Sprintf(`{"ref": "refs/heads/master", "before": %q, "after": %q,
+		"total_commits": 1, "pusher": {"login": "testuser"},
+		"repository": {"full_name": "example/repo", "clone_url": %q},
+		"nongithub": {"wait": true}}`, zeroSha, sha, dir)
+	bitbucket := fmt.Sprintf(`{"actor": {"nickname": "testuser"},
+		"repository": {"full_name": "example/repo", "links": {"html": {"href": %q}}},
+		"push": {"changes": [{"old": null,
+			"new": {"type": "branch", "name": "master", "target": {"hash": %q}}}]},
+		"nongithub": {"wait": true}}`, dir, sha)
+
+	for _, c := range []struct {
+		provider  string
+		body      string
+		bad, good []string // headers
+		status    string   // where the statuses go
+		auth      string   // header, value
+		state     string
+	}{
+		{"gitlab", gitlab,
+			[]string{"X-Gitlab-Event", "Push Hook", "X-Gitlab-Token", "wrong"},
+			[]string{"X-Gitlab-Event", "Push Hook", "X-Gitlab-Token", "gl-secret"},
+			"/gitlab/api/v4/projects/example%2Fsub%2Frepo/statuses/" + sha,
+			"Private-Token gl-token", `"state":"success"`},
+		{"gitea", gitea,
+			// Gitea sends X-GitHub-Event too
+			[]string{"X-Gitea-Event", "push", "X-Github-Event", "push",
+				"X-Gitea-Signature", sign("wrong", gitea)},
+			[]string{"X-Gitea-Event", "push", "X-Github-Event", "push",
+				"X-Gitea-Signature", sign("gt-secret", gitea)},
+			"/gitea/api/v1/repos/example/repo/statuses/" + sha,
+			"Authorization token gt-token", `"state":"success"`},
+		{"bitbucket", bitbucket,
+			[]string{"X-Event-Key", "repo:push"},
+			[]string{"X-Event-Key", "repo:push",
+				"X-Hub-Signature", "sha256=" + sign("bb-secret", bitbucket)},
+			"/bitbucket/2.0/repositories/example/repo/commit/" + sha + "/statuses/build",
+			"Authorization Basic " + base64.StdEncoding.EncodeToString([]byte("tang:bb-password")),
+			`"state":"SUCCESSFUL"`},
+	} {
+		if code := post(c.body, c.bad...); code != http.StatusUnauthorized {
+			t.Errorf("%v: expected a bad secret to be refused, got %d", c.provider, code)
+		}
+		if code := post(c.body, c.good...); code != http.StatusOK {
+			t.Errorf("%v: expected the push to be built, got %d", c.provider, code)
+			continue
+		}
+
+		r := buildStore.List()[0]
+		if r.Repository.Provider != c.provider || r.Sha != sha || r.State != StateSuccess {
+			t.Errorf("%v: unexpected build %v %v %v %v", c.provider, r.Repository.Provider,
+				r.Sha, r.State, r.Error)
+		}
+
+		// Only those sent to this provider, whatever else was going on
+		var requests []recordedRequest
+		for _, req := range sentToGithub(t) {
+			if strings.HasPrefix(req.Path, "/"+c.provider+"/") {
+				requests = append(requests, req)
+			}
+		}
+		if len(requests) == 0 {
+			t.Errorf("%v: no statuses sent", c.provider)
+			continue
+		}
+		auth := strings.SplitN(c.auth, " ", 2)
+		for _, req := range requests {
+			if req.Path != c.status || req.Header.Get(auth[0]) != auth[1] {
+				t.Errorf("%v: unexpected request %v %v", c.provider, req.Method, req.Path)
+			}
+		}
+		if last := requests[len(requests)-1]; !strings.Contains(string(last.Body), c.state) {
+			t.Errorf("%v: expected %v, got %s", c.provider, c.state, last.Body)
+		}
+	}
+
+	// Merge requests are built when they are opened, or have commits pushed
+	mr := `{"object_kind": "merge_request", "user": {"username": "stranger"},
+		"project": {"path_with_namespace": "example/repo", "git_http_url": "."},
+		"object_attributes": {"iid": 3, "action": %q, "oldrev": %q,
+			"last_commit": {"id": "ee7c7b8f65dea5d3ef81c17eacd1b873be167109"}}}`
+	for _, c := range []struct {
+		action, oldrev string
+		expected       error
+	}{
+		{"update", "", nil},
+		{"close", "", nil},
+		{"update", zeroSha, ErrUserNotAllowed},
+		{"open", "", ErrUserNotAllowed},
+	} {
+		err := gitlabProvider{}.Handle("Merge Request Hook",
+			[]byte(fmt.Sprintf(mr, c.action, c.oldrev)))
+		if err != c.expected {
+			t.Errorf("Merge request %v %q: expected %v, got %v", c.action, c.oldrev,
+				c.expected, err)
+		}
+	}
+}
+
+// Only github is configured, so hooks which claim to be from elsewhere mustn't
+// get around its signature.
+func TestForgedProviders(t *testing.T) {
+	defer IndentLogger()()
+
+	github_webhook_secret = "s3cret"
+	defer func() { github_webhook_secret = "" }()
+
+	allowedPushersSet["testuser"] = true
+	defer delete(allowedPushersSet, "testuser")
+
+	url := "https://evil.example.com/example/forged.git"
+	gitlab := fmt.Sprintf(`{"ref": "refs/heads/master", "before": %q,
+		"after": "ee7c7b8f65dea5d3ef81c17eacd1b873be167109", "user_username": "testuser",
+		"project": {"path_with_namespace": "example/forged", "git_http_url": %q}}`,
+		zeroSha, url)
+	gitea := fmt.Sprintf(`{"ref": "refs/heads/master", "before": %q,
+		"after": "ee7c7b8f65dea5d3ef81c17eacd1b873be167109", "pusher": {"login": "testuser"},
+		"repository": {"full_name": "example/forged", "clone_url": %q}}`, zeroSha, url)
+
+	for _, c := range []struct {
+		name     string
+		body     string
+		header   []string
+		expected int
+	}{
+		{"gitlab", gitlab, []string{"X-Gitlab-Event", "Push Hook"}, http.StatusBadRequest},
+		{"gitlab with a token", gitlab,
+			[]string{"X-Gitlab-Event", "Push Hook", "X-Gitlab-Token", ""},
+			http.StatusBadRequest},
+		// Gitea's look like github's, so must be signed like them
+		{"gitea", gitea, []string{"X-Gitea-Event", "push", "X-Github-Event", "push"},
+			http.StatusUnauthorized},
+		{"bitbucket", "{}", []string{"X-Event-Key", "repo:push"}, http.StatusBadRequest},
+	} {
+		r, err := http.NewRequest("POST", "/hook", strings.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(c.header); i += 2 {
+			r.Header.Set(c.header[i], c.header[i+1])
+		}
+		w := httptest.NewRecorder()
+		handleHook(w, r)
+		if w.Code != c.expected {
+			t.Errorf("%v: got %d, expected %d", c.name, w.Code, c.expected)
+		}
+	}
+
+	for _, r := range buildStore.List() {
+		if r.Repository.Name == "forged" {
+			t.Errorf("Forged hook was built: %+v", r)
+		}
+	}
+}
+
+func TestBuildQueue(t *testing.T) {
+	defer IndentLogger()()
+
+	q := NewBuildQueue(3)
+
+	var mu sync.Mutex
+	busy := map[string]bool{}
+	q.run = func(b *Build) error {
+		mu.Lock()
+		if busy[b.RepoName()] {
+			t.Error("Concurrent builds of", b.RepoName())
+		}
+		busy[b.RepoName()] = true
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		busy[b.RepoName()] = false
+		mu.Unlock()
+		return nil
+	}
+
+	var builds []*Build
+	for _, name := range []string{"a", "a", "b", "c"} {
+		b := &Build{BuildRecord: BuildRecord{
+			Repository: Repository{Name: name, Organization: "example"},
+		}}
+		err := q.Submit(b)
+		if name == "c" {
+			if err != ErrQueueFull {
+				t.Error("Expected ErrQueueFull, got", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		builds = append(builds, b)
+	}
+
+	if q.Len() != 3 {
+		t.Error("Expected 3 waiting builds, got", q.Len())
+	}
+
+	q.Start(2)
+	for _, b := range builds {
+		if err := b.Wait(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestSupersede(t *testing.T) {
+	defer IndentLogger()()
+
+	q := NewBuildQueue(10)
+	q.run = func(b *Build) error {
+		select {
+		case <-b.cancel:
+			return ErrSuperseded
+		case <-time.After(100 * time.Millisecond):
+			return nil
+		}
+	}
+	q.Start(1)
+
+	push := func(sha string) *Build {
+		b := &Build{BuildRecord: BuildRecord{
+			Repository: Repository{Name: "tang", Organization: "example"},
+			Ref:        "refs/heads/master",
+			Sha:        sha,
+		}}
+		if err := q.Submit(b); err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	first := push("1111111111")
+	for {
+		running, _ := q.Snapshot()
+		if len(running) == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	second := push("2222222222")
+	third := push("3333333333")
+
+	for b, expected := range map[*Build]error{
+		first:  ErrSuperseded,
+		second: ErrSuperseded,
+		third:  nil,
+	} {
+		if err := b.Wait(); err != expected {
+			t.Errorf("%v: got %v, expected %v", b.Sha, err, expected)
+		}
+	}
+
+	// A full queue still takes a build which supersedes a waiting one
+	full := NewBuildQueue(1)
+	older := &Build{BuildRecord: BuildRecord{
+		Repository: Repository{Name: "tang", Organization: "example"},
+		Ref:        "refs/heads/master",
+		Sha:        "4444444444",
+	}}
+	newer := &Build{BuildRecord: older.BuildRecord}
+	newer.Sha = "5555555555"
+	if err := full.Submit(older); err != nil {
+		t.Fatal(err)
+	}
+	if err := full.Submit(newer); err != nil {
+		t.Error("Expected the superseding build to be queued, got", err)
+	}
+	if err := older.Wait(); err != ErrSuperseded {
+		t.Errorf("%v: got %v, expected %v", older.Sha, err, ErrSuperseded)
+	}
+}
+
+func TestConcurrencyGroups(t *testing.T) {
+	defer IndentLogger()()
+	defer inTempDir(t)()
+
+	lock, err := ioutil.TempDir("", "tang-group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(lock)
+
+	allowedPushersSet["testuser"] = true
+	defer delete(allowedPushersSet, "testuser")
+
+	// Each hook holds a lock for a while, which it can't get if the other
+	// is running too.
+	files := map[string]string{
+		"tang.hook": fmt.Sprintf("#!/bin/sh\nmkdir %q || exit 1\nsleep 0.3\nrmdir %q\n",
+			lock+"/held", lock+"/held"),
+		"tang.yml": "concurrency: deploy\n",
+	}
+
+	// Two workers, so that only the group keeps the builds apart
+	q := NewBuildQueue(10)
+	var builds []*Build
+	for _, name := range []string{"group-a", "group-b"} {
+		dir, sha := makeRepo(t, files)
+		defer os.RemoveAll(dir)
+		b := &Build{BuildRecord: BuildRecord{
+			Repository: Repository{Name: name, Organization: "example", Url: dir},
+			Ref:        "refs/heads/master",
+			Sha:        sha,
+			Checkout:   sha,
+			Pusher:     Pusher{Name: "testuser"},
+		}}
+		if err := q.Submit(b); err != nil {
+			t.Fatal(err)
+		}
+		builds = append(builds, b)
+	}
+	q.Start(2)
+
+	for _, b := range builds {
+		if err := b.Wait(); err != nil || b.State != StateSuccess {
+			t.Errorf("%v: expected success, got %v %v", b.RepoName(), b.State, err)
+		}
+	}
+	first, second := builds[0], builds[1]
+	if second.Started.Before(first.Started) {
+		first, second = second, first
+	}
+	if second.Started.Before(first.Finished) {
+		t.Errorf("Builds in the same group overlapped: %v ran from %v, %v until %v",
+			second.RepoName(), second.Started, first.RepoName(), first.Finished)
+	}
+}
+
+// A bytes.Buffer which is safe to write to from several goroutines
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestHookTimeout(t *testing.T) {
+	defer IndentLogger()()
+
+	dir, err := ioutil.TempDir("", "tang-timeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A hook which ignores SIGTERM, so that it has to be killed.
+	hook := "#!/bin/sh\ntrap '' TERM\nsleep 30 &\nwait\n"
+	err = ioutil.WriteFile(path.Join(dir, "tang.hook"), []byte(hook), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(timeout, grace time.Duration) {
+		*hookTimeout, *killGrace = timeout, grace
+	}(*hookTimeout, *killGrace)
+	*hookTimeout, *killGrace = 100*time.Millisecond, 100*time.Millisecond
+
+	b := &Build{BuildRecord: BuildRecord{ID: "1"}}
+	out := &lockedBuffer{}
+	err = runTang("example/tang", dir, out, b)
+	if err != ErrNoLogDir {
+		t.Error("Expected the build to need a log directory, got", err)
+	}
+
+	b.LogPath = path.Join(dir, "log.txt")
+	start := time.Now()
+	err = runTang("example/tang", dir, out, b)
+	if err == nil || !strings.HasPrefix(err.Error(), "timed out after") {
+		t.Error("Expected a timeout, got", err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Error("Hook was not killed promptly")
+	}
+	if !strings.Contains(out.String(), "sending SIGKILL") {
+		t.Errorf("Expected hook to be SIGKILLed, log: %q", out.String())
+	}
+}
+
+func TestStopHooks(t *testing.T) {
+	defer IndentLogger()()
+
+	dir, err := ioutil.TempDir("", "tang-stop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A hook which ignores SIGTERM, as does what it starts
+	hook := "#!/bin/sh\ntrap '' TERM\ntouch started\nsleep 30 &\nwait\n"
+	err = ioutil.WriteFile(path.Join(dir, "tang.hook"), []byte(hook), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(grace time.Duration) { *killGrace = grace }(*killGrace)
+	*killGrace = 100 * time.Millisecond
+
+	b := &Build{BuildRecord: BuildRecord{ID: "1", LogPath: path.Join(dir, "log.txt")}}
+	exited := make(chan error, 1)
+	go func() { exited <- runTang("example/tang", dir, &lockedBuffer{}, b) }()
+
+	for {
+		if _, err := os.Stat(path.Join(dir, "started")); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// As when tang exits
+	stopHooks()
+	select {
+	case err := <-exited:
+		if err == nil {
+			t.Error("Expected the hook to have been killed")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Hook outlived tang")
+	}
+	if signalHooks(0) != 0 {
+		t.Error("Expected no hooks to be running")
+	}
+}
+
+func TestOldLogRedirect(t *testing.T) {
+	defer IndentLogger()()
+
+	logDir, err := ioutil.TempDir("", "tang-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(logDir)
+
+	sha := "ee7c7b8f65dea5d3ef81c17eacd1b873be167109"
+	for _, id := range []string{"1", "2"} {
+		dir := path.Join(logDir, "example", "tang", sha, id)
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(path.Join(dir, "log.txt"), []byte(id), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	handler := http.StripPrefix("/tang/logs/", LogHandler(logDir))
+
+	for url, expected := range map[string]string{
+		"/tang/logs/ee7c7b/log.txt": "/tang/logs/example/tang/" + sha + "/2/log.txt",
+		"/tang/logs/000000/log.txt": "",
+	} {
+		r, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if location := w.Header().Get("Location"); location != expected {
+			t.Errorf("%v: redirected to %q, expected %q", url, location, expected)
+		}
+	}
+}
+
+func TestTangURL(t *testing.T) {
+	defer func(url string) { *publicURL = url }(*publicURL)
+
+	for _, base := range []string{"https://ci.example.com/tang", "https://ci.example.com/tang/"} {
+		*publicURL = base
+		if url := tangURL("logs/example/log.txt"); url != "https://ci.example.com/tang/logs/example/log.txt" {
+			t.Errorf("%v: unexpected URL %v", *publicURL, url)
+		}
+	}
+}
+
+func TestBuildStore(t *testing.T) {
+	defer IndentLogger()()
+
+	dir, err := ioutil.TempDir("", "tang-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "builds.json")
+
+	s, err := OpenBuildStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []BuildRecord{
+		{ID: "1", State: StateQueued, Queued: time.Now()},
+		{ID: "1", State: StateSuccess, Queued: time.Now()},
+		{ID: "2", State: StateRunning, Queued: time.Now().Add(time.Second),
+			Repository: Repository{Name: "store", Organization: "example"}, Sha: "abc",
+			Statuses: []GithubStatus{{State: "pending", Context: "ci/store"}}},
+	} {
+		if err := s.Save(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Reopening it is what happens when tang restarts
+	s, err = OpenBuildStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	builds := s.List()
+	if len(builds) != 2 || builds[0].ID != "2" || builds[1].ID != "1" {
+		t.Fatalf("Unexpected builds %+v", builds)
+	}
+	if builds[0].State != StateInterrupted {
+		t.Error("Running build should be interrupted, is", builds[0].State)
+	}
+	if builds[1].State != StateSuccess {
+		t.Error("Last save should win, state is", builds[1].State)
+	}
+
+	// Github hears that the build won't finish
+	resetGithub(t)
+	reportInterrupted(s)
+	requests := sentToGithub(t)
+	var status GithubStatus
+	if len(requests) == 1 {
+		json.Unmarshal(requests[0].Body, &status)
+	}
+	if len(requests) != 1 || requests[0].Path != "/repos/example/store/statuses/abc" ||
+		status.State != "error" || status.Context != "ci/store" {
+		t.Errorf("Expected an error status for the interrupted build, got %+v", requests)
+	}
+	if r, _ := s.Get("2"); r.Statuses[len(r.Statuses)-1] != status {
+		t.Errorf("Expected the status to be recorded, got %+v", r.Statuses)
+	}
+
+	// Only once
+	s, err = OpenBuildStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reportInterrupted(s)
+	if requests := sentToGithub(t); len(requests) != 0 {
+		t.Errorf("Expected no more statuses, got %+v", requests)
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	defer IndentLogger()()
+
+	err := buildStore.Save(BuildRecord{
+		ID:         newBuildID(),
+		Repository: Repository{Name: "dashboard", Organization: "example"},
+		Ref:        "refs/heads/master",
+		Sha:        "ee7c7b8f65dea5d3ef81c17eacd1b873be167109",
+		State:      StateFailure,
+		LogPath:    "logs/example/dashboard/ee7c7b8f65dea5d3ef81c17eacd1b873be167109/1/log.txt",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for url, expected := range map[string]int{
+		"/tang/":         http.StatusOK,
+		"/tang/elephant": http.StatusNotFound,
+	} {
+		r, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		handleTang(w, r)
+
+		if w.Code != expected {
+			t.Errorf("%v: got %d, expected %d", url, w.Code, expected)
+		}
+		if expected != http.StatusOK {
+			continue
+		}
+		for _, s := range []string{"example/dashboard", `class="state failure"`,
+			`href="/tang/logs/example/dashboard/`} {
+			if !strings.Contains(w.Body.String(), s) {
+				t.Errorf("Dashboard doesn't contain %q", s)
+			}
+		}
+	}
+}
+
+func TestAPI(t *testing.T) {
+	defer IndentLogger()()
+
+	dir, err := ioutil.TempDir("", "tang-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logPath := path.Join(dir, "log.txt")
+	err = ioutil.WriteFile(logPath, []byte("0123456789"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := newBuildID()
+	err = buildStore.Save(BuildRecord{
+		ID:         id,
+		Repository: Repository{Name: "api", Organization: "example"},
+		Ref:        "refs/heads/feature",
+		Pusher:     Pusher{Name: "apiuser"},
+		State:      StateSuccess,
+		LogPath:    logPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(url string, header http.Header) *httptest.ResponseRecorder {
+		r, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		handleAPI(w, r)
+		return w
+	}
+
+	var builds []BuildRecord
+	w := get("/tang/api/builds?repo=example/api&ref=feature&pusher=apiuser", nil)
+	err = json.Unmarshal(w.Body.Bytes(), &builds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 1 || builds[0].ID != id {
+		t.Errorf("Unexpected builds %+v", builds)
+	}
+
+	w = get("/tang/api/builds?repo=example/api&state=failure", nil)
+	if strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Errorf("Expected no failed builds, got %v", w.Body.String())
+	}
+
+	w = get("/tang/api/builds/nonexistent", nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown build, got %d", w.Code)
+	}
+
+	w = get("/tang/api/builds/"+id+"/log", http.Header{"Range": {"bytes=4-"}})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "456789" {
+		t.Errorf("Range request: got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestLiveLog(t *testing.T) {
+	defer IndentLogger()()
+
+	dir, err := ioutil.TempDir("", "tang-live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logPath := path.Join(dir, "log.txt")
+	err = ioutil.WriteFile(logPath, []byte("Tests passed\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := newBuildID()
+	err = buildStore.Save(BuildRecord{ID: id, State: StateSuccess, LogPath: logPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(LiveLogHandler))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/tang/live/logs/nonexistent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown build, got %d", resp.StatusCode)
+	}
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/tang/live/logs/" + id
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	var messages []string
+	for {
+		_, message, err := ws.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				t.Error("Expected a normal close, got", err)
+			}
+			break
+		}
+		messages = append(messages, string(message))
+	}
+
+	if len(messages) != 2 || messages[0] != "Tests passed\n" ||
+		!strings.Contains(messages[1], `"state":"success"`) {
+		t.Errorf("Unexpected messages %q", messages)
+	}
+}
+
+func TestSSELog(t *testing.T) {
+	defer IndentLogger()()
+
+	dir, err := ioutil.TempDir("", "tang-sse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logPath := path.Join(dir, "log.txt")
+	err = ioutil.WriteFile(logPath, []byte("one\ntwo\nthree"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := newBuildID()
+	err = buildStore.Save(BuildRecord{ID: id, State: StateFailure, LogPath: logPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := http.NewRequest("GET", "/tang/sse/logs/"+id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Resume after the first line
+	r.Header.Set("Last-Event-ID", "4")
+	w := httptest.NewRecorder()
+	SSELogHandler(w, r)
+
+	expected := "id: 8\ndata: two\n\nid: 13\ndata: three\n\nevent: status\nid: 13\ndata: {"
+	if !strings.HasPrefix(w.Body.String(), expected) {
+		t.Errorf("Unexpected events %q", w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), `"state":"failure"`) {
+		t.Errorf("Status event is missing the state: %q", w.Body.String())
+	}
+}
+
+func TestParseRepoFile(t *testing.T) {
+	rf, err := ParseRepoFile([]byte(`
+hook: make test
+timeout: 20m
+branches:
+  include: [master, "release-*"]
+  exclude: [release-old]
+env:
+  GOFLAGS: -v
+context: tang/build
+concurrency: deploy
+pull_requests: false
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rf.Hook != "make test" || rf.timeout != 20*time.Minute ||
+		rf.Context != "tang/build" || rf.Concurrency != "deploy" ||
+		rf.BuildPullRequests() || rf.Environ()[0] != "GOFLAGS=-v" {
+		t.Errorf("Unexpected RepoFile %+v", rf)
+	}
+
+	for branch, expected := range map[string]bool{
+		"master":      true,
+		"release-1.0": true,
+		"release-old": false,
+		"feature":     false,
+	} {
+		if rf.Branches.Match(branch) != expected {
+			t.Errorf("Branch %q: expected match = %v", branch, expected)
+		}
+	}
+
+	for _, bad := range []string{
+		"timeout: soon",
+		"branches: {include: ['[']}",
+		"env: {TANG_SHA: x}",
+		"env: {'not a name': x}",
+		"colour: blue",
+		"hook: [",
+	} {
+		if _, err := ParseRepoFile([]byte(bad)); err == nil {
+			t.Errorf("Expected %q to be invalid", bad)
+		}
+	}
+}
+
+// Run the test in a temporary directory, so that the git mirrors and logs
+// its builds make (under repo/ and logs/) are removed afterwards, and don't
+// get in the way of the next run. Use as `defer inTempDir(t)()`.
+func inTempDir(t *testing.T) func() {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "tang-wd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	}
+}
+
+// Make a git repository in a temporary directory containing `files`, the
+// mode of which is 0755 if their name ends in ".hook". Returns the directory
+// and the sha of the commit.
+func makeRepo(t *testing.T, files map[string]string) (dir, sha string) {
+	dir, err := ioutil.TempDir("", "tang-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range files {
+		mode := os.FileMode(0644)
+		if strings.HasSuffix(name, ".hook") {
+			mode = 0755
+		}
+		filename := path.Join(dir, name)
+		err = os.MkdirAll(path.Dir(filename), 0777)
+		if err == nil {
+			err = ioutil.WriteFile(filename, []byte(content), mode)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	git := func(args ...string) string {
+		cmd := Command(dir, "git", args...)
+		cmd.Stdout = nil
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=tang", "GIT_AUTHOR_EMAIL=tang@example.com",
+			"GIT_COMMITTER_NAME=tang", "GIT_COMMITTER_EMAIL=tang@example.com")
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "-q")
+	git("add", ".")
+	git("commit", "-q", "-m", "test")
+	return dir, git("rev-parse", "HEAD")
+}
+
+// Build the only commit of a repository made by makeRepo().
+func buildRepo(t *testing.T, name string, files map[string]string) *Build {
+	dir, sha := makeRepo(t, files)
+	defer os.RemoveAll(dir)
+
+	allowedPushersSet["testuser"] = true
+	defer delete(allowedPushersSet, "testuser")
+
+	b := &Build{
+		BuildRecord: BuildRecord{
+			Repository: Repository{Name: name, Organization: "example", Url: dir},
+			Ref:        "refs/heads/master",
+			Sha:        sha,
+			Checkout:   sha,
+			Pusher:     Pusher{Name: "testuser"},
+		},
+		NonGithub: NonGithub{Wait: true},
+	}
+	submitBuild(b)
+	return b
+}
+
+func TestRepoFileBuild(t *testing.T) {
+	defer IndentLogger()()
+	defer inTempDir(t)()
+
+	b := buildRepo(t, "repofile", map[string]string{
+		"tang.yml": "hook: test \"$GREETING\" = hello\nenv: {GREETING: hello}\ncontext: tang/test\n",
+	})
+	if b.State != StateSuccess {
+		t.Errorf("Expected success, got %v %v", b.State, b.Error)
+	}
+	if last := b.Statuses[len(b.Statuses)-1]; last.Context != "tang/test" {
+		t.Errorf("Expected status context tang/test, got %+v", last)
+	}
+
+	b = buildRepo(t, "repofile-broken", map[string]string{
+		"tang.hook": "#!/bin/sh\n",
+		"tang.yml":  "timeout: never\n",
+	})
+	if b.State != StateFailure || len(b.Statuses) != 1 ||
+		!strings.Contains(b.Statuses[0].Description, "timeout") {
+		t.Errorf("Expected a failure about the timeout, got %v %+v", b.State, b.Statuses)
+	}
+
+	b = buildRepo(t, "repofile-branches", map[string]string{
+		"tang.hook": "#!/bin/sh\nexit 1\n",
+		"tang.yml":  "branches: {exclude: [master]}\n",
+	})
+	if b.State != StateSkipped || len(b.Statuses) != 0 {
+		t.Errorf("Expected master to be skipped, got %v %+v", b.State, b.Statuses)
+	}
+}
+
+func TestRefFilters(t *testing.T) {
+	defer IndentLogger()()
+
+	branches := Filter{Include: []string{"master", "release-*"}}
+	tags := Filter{Exclude: []string{"*"}}
+
+	defer func(c *Config) { tangConfig = c }(tangConfig)
+	tangConfig = &Config{
+		Defaults: RepoConfig{Tags: &tags},
+		Repositories: map[string]RepoConfig{
+			"example/filtered": {Branches: &branches},
+		},
+	}
+
+	for ref, expected := range map[string]bool{
+		"refs/heads/master":    true,
+		"refs/heads/release-1": true,
+		"refs/heads/feature":   false,
+		"refs/tags/v1.0":       false,
+		"refs/pull/1/head":     true,
+	} {
+		if tangConfig.Repo("example/filtered").BuildsRef(ref) != expected {
+			t.Errorf("%v: expected BuildsRef = %v", ref, expected)
+		}
+	}
+
+	allowedPushersSet["testuser"] = true
+	defer delete(allowedPushersSet, "testuser")
+
+	sha := "f117e7edf117e7edf117e7edf117e7edf117e7ed"
+	err := eventPush(PushEvent{
+		Ref:        "refs/heads/feature",
+		Repository: Repository{Name: "filtered", Organization: "example", Url: "."},
+		After:      sha,
+		Pusher:     Pusher{Name: "testuser"},
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	for _, r := range buildStore.List() {
+		if r.Sha == sha {
+			t.Error("Excluded ref was queued:", r.State)
+		}
+	}
+}
+
+func TestPathFilters(t *testing.T) {
+	defer IndentLogger()()
+	defer inTempDir(t)()
+
+	paths := Filter{Include: []string{"services/*/**", "go.mod"}, Exclude: []string{"*/*/*.md"}}
+	for name, expected := range map[string]bool{
+		"services/api/main.go":     true,
+		"services/api/cmd/main.go": true,
+		"services/api/README.md":   false,
+		"services/api":             false,
+		"go.mod":                   true,
+		"docs/index.md":            false,
+	} {
+		if paths.Match(name) != expected {
+			t.Errorf("%v: expected Match = %v", name, expected)
+		}
+	}
+
+	dir, sha := makeRepo(t, map[string]string{
+		"tang.hook":     "#!/bin/sh\ntrue\n",
+		"tang.yml":      "paths:\n  include: [\"src/**\"]\n",
+		"src/main.go":   "package main\n",
+		"docs/index.md": "# docs\n",
+		"docs/read me":  "# docs\n",
+	})
+	defer os.RemoveAll(dir)
+
+	const emptyTree = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+	files, err := gitChangedFiles(dir, emptyTree, sha)
+	if err != nil || strings.Join(files, ",") != "docs/index.md,docs/read me,src/main.go,tang.hook,tang.yml" {
+		t.Errorf("gitChangedFiles() = %q, %v", files, err)
+	}
+
+	allowedPushersSet["testuser"] = true
+	defer delete(allowedPushersSet, "testuser")
+
+	for _, changed := range [][]string{{"docs/index.md"}, {"docs/index.md", "src/main.go"}} {
+		b := &Build{
+			BuildRecord: BuildRecord{
+				Repository: Repository{Name: "paths", Organization: "example", Url: dir},
+				Ref:        "refs/heads/master",
+				Sha:        sha,
+				Checkout:   sha,
+				Pusher:     Pusher{Name: "testuser"},
+			},
+			NonGithub:    NonGithub{Wait: true},
+			changedFiles: changed,
+		}
+		submitBuild(b)
+
+		relevant := len(changed) > 1
+		switch {
+		case relevant && b.State != StateSuccess:
+			t.Errorf("%v: expected success, got %v %v", changed, b.State, b.Error)
+		case !relevant && b.State != StateSkipped:
+			t.Errorf("%v: expected skipped, got %v %v", changed, b.State, b.Error)
+		case !relevant && b.Statuses[len(b.Statuses)-1].State != "success":
+			t.Errorf("%v: skipped build should report success", changed)
+		}
+	}
+
+	// Without a tang.hook there's nothing to skip, so no status either
+	noHook, noHookSha := makeRepo(t, map[string]string{
+		"tang.yml":      "paths:\n  include: [\"src/**\"]\n",
+		"docs/index.md": "# docs\n",
+	})
+	defer os.RemoveAll(noHook)
+	b := &Build{
+		BuildRecord: BuildRecord{
+			Repository: Repository{Name: "paths-no-hook", Organization: "example", Url: noHook},
+			Ref:        "refs/heads/master",
+			Sha:        noHookSha,
+			Checkout:   noHookSha,
+			Pusher:     Pusher{Name: "testuser"},
+		},
+		NonGithub:    NonGithub{Wait: true},
+		changedFiles: []string{"docs/index.md"},
+	}
+	submitBuild(b)
+	if len(b.Statuses) != 0 {
+		t.Errorf("Build without tang.hook: got %v with statuses %v", b.State, b.Statuses)
+	}
+
+	files, ok := PushEvent{Commits: []Commit{
+		{Added: []string{"a"}, Modified: []string{"b"}},
+		{Removed: []string{"a"}},
+	}}.ChangedFiles()
+	if !ok || strings.Join(files, " ") != "a b" {
+		t.Errorf("ChangedFiles() = %v, %v", files, ok)
+	}
+	if _, ok := (PushEvent{}).ChangedFiles(); ok {
+		t.Error("ChangedFiles() should be unknown without commits")
+	}
+}
+
+func TestReleaseEvents(t *testing.T) {
+	defer IndentLogger()()
+	defer inTempDir(t)()
+
+	dir, sha := makeRepo(t, map[string]string{
+		"tang.hook": "#!/bin/sh\necho \"tag=$TANG_TAG release=$TANG_RELEASE_NAME\"\ntest \"$TANG_TAG\" = v1\n",
+	})
+	defer os.RemoveAll(dir)
+	tag := Command(dir, "git", "tag", "-a", "-m", "v1", "v1")
+	tag.Env = append(os.Environ(), "GIT_COMMITTER_NAME=tang", "GIT_COMMITTER_EMAIL=tang@example.com")
+	if err := tag.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	allowedPushersSet["testuser"] = true
+	defer delete(allowedPushersSet, "testuser")
+
+	repository := PullRequestRepository{Name: "releases", CloneUrl: dir,
+		Owner: GithubUser{Login: "example"}}
+
+	// The most recently queued build, once it has finished
+	latest := func() BuildRecord {
+		r := buildStore.List()[0]
+		if b := buildQueue.Lookup(r.ID); b != nil {
+			b.Wait()
+		}
+		r, _ = buildStore.Get(r.ID)
+		return r
+	}
+
+	err := eventRelease(ReleaseEvent{
+		Action:     "published",
+		Release:    Release{TagName: "v1", Name: "First release"},
+		Repository: repository,
+		Sender:     GithubUser{Login: "testuser"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := latest()
+	if r.State != StateSuccess || r.Sha != sha || r.Release != "First release" {
+		t.Fatalf("Release build: %v %v %q %v", r.State, r.Sha, r.Release, r.Error)
+	}
+	data, err := ioutil.ReadFile(r.LogPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "tag=v1 release=First release") {
+		t.Errorf("Hook environment missing from log: %q", data)
+	}
+
+	// The same tag is only built once more, for its creation
+	create := CreateEvent{Ref: "v1", RefType: "tag", Repository: repository,
+		Sender: GithubUser{Login: "testuser"}}
+	for _, expected := range []string{StateSuccess, StateSkipped} {
+		if err := eventCreateTag(create); err != nil {
+			t.Fatal(err)
+		}
+		if r := latest(); r.State != expected {
+			t.Errorf("Create build: expected %v, got %v %v", expected, r.State, r.Error)
+		}
+	}
+
+	err = eventRelease(ReleaseEvent{
+		Action:     "published",
+		Release:    Release{TagName: "v1"},
+		Repository: repository,
+		Sender:     GithubUser{Login: "stranger"},
+	})
+	if err != ErrUserNotAllowed {
+		t.Errorf("Expected ErrUserNotAllowed, got %v", err)
+	}
+}
+
+func TestGitCredentials(t *testing.T) {
+	defer IndentLogger()()
+
+	home, err := ioutil.TempDir("", "tang-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", home)
+
+	defer func(token string) { github_token = token }(github_token)
+	github_token = "s3cret"
+
+	cmd := gitCommand(Repository{Name: "repo", Organization: "example"}, ".",
+		"credential", "fill")
+	cmd.Stdin = strings.NewReader("protocol=https\nhost=github.com\n\n")
+	cmd.Stdout = nil
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "password=s3cret\n") {
+		t.Errorf("Expected the token from git credential fill, got %q", out)
+	}
+	if strings.Contains(strings.Join(cmd.Args, " "), "s3cret") {
+		t.Error("Token is in the git command line")
+	}
+	if _, err := os.Stat(path.Join(home, ".gitconfig")); !os.IsNotExist(err) {
+		t.Error("Expected no ~/.gitconfig, got", err)
+	}
+
+	req, _ := http.NewRequest("GET", Endpoint("user"), nil)
+	setGithubAuth(req, "example/repo")
+	if req.Header.Get("Authorization") != "token s3cret" || strings.Contains(req.URL.String(), "s3cret") {
+		t.Errorf("Token should be in the header, not the URL: %v %v", req.URL, req.Header)
+	}
+}
+
+func TestGithubApp(t *testing.T) {
+	defer IndentLogger()()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile, err := ioutil.TempFile("", "tang-app-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(keyFile.Name())
+	pem.Encode(keyFile, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	keyFile.Close()
+
+	// A fake github which checks the JWT and hands out tokens, counting them
+	var (
+		mu     sync.Mutex
+		issued int
+		expiry = time.Now().Add(time.Hour)
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), ".")
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[len(parts)-1])
+		digest := sha256.Sum256([]byte(strings.Join(parts[:len(parts)-1], ".")))
+		if len(parts) != 3 || rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature) != nil {
+			http.Error(w, "bad JWT", http.StatusUnauthorized)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/repos/example/repo/installation":
+			fmt.Fprint(w, `{"id": 42}`)
+		case r.Method == "POST" && r.URL.Path == "/app/installations/42/access_tokens":
+			issued++
+			json.NewEncoder(w).Encode(installationToken{
+				Token: fmt.Sprint("token-", issued), ExpiresAt: expiry})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	defer func(api string) { *githubAPI = api }(*githubAPI)
+	*githubAPI = server.URL
+
+	app, err := LoadGithubApp(1234, keyFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(app *GithubApp) { githubApp = app }(githubApp)
+	githubApp = app
+
+	for i := 0; i < 2; i++ {
+		token, err := app.Token("example/repo")
+		if err != nil || token != "token-1" {
+			t.Errorf("Expected the cached token-1, got %q %v", token, err)
+		}
+	}
+
+	// Renewed when it is about to expire
+	app.mu.Lock()
+	app.tokens["example"] = installationToken{Token: "token-1", ExpiresAt: time.Now()}
+	app.mu.Unlock()
+	if token, err := app.Token("example/repo"); err != nil || token != "token-2" {
+		t.Errorf("Expected a new token-2, got %q %v", token, err)
+	}
+
+	if _, err := app.Token("other/repo"); err == nil {
+		t.Error("Expected an error for a repository without an installation")
+	}
+
+	// git gets the installation token too
+	cmd := gitCommand(Repository{Name: "repo", Organization: "example"}, ".",
+		"credential", "fill")
+	cmd.Stdin = strings.NewReader("protocol=https\nhost=github.com\n\n")
+	cmd.Stdout = nil
+	out, err := cmd.Output()
+	if err != nil || !strings.Contains(string(out), "password=token-2\n") {
+		t.Errorf("Expected the installation token from git, got %q %v", out, err)
+	}
+}
+
+// Send the statuses in the outbox to the fake github, and return the
+// requests made to it since the last call.
+func sentToGithub(t *testing.T) []recordedRequest {
+	if !statusOutbox.sendAll() {
+		t.Error("Statuses couldn't be sent to the fake github")
+	}
+	return fakeGithub.Take()
+}
+
+// Forget the statuses and requests left behind by earlier tests.
+func resetGithub(t *testing.T) {
+	sentToGithub(t)
+}
+
+func TestGithubRequests(t *testing.T) {
+	defer IndentLogger()()
+	defer inTempDir(t)()
+
+	resetGithub(t)
+	b := buildRepo(t, "statuses", map[string]string{
+		"tang.hook": "#!/bin/sh\ntrue\n",
+	})
+	if b.State != StateSuccess {
+		t.Fatalf("Expected success, got %v %v", b.State, b.Error)
+	}
+	requests := sentToGithub(t)
+	var states []string
+	for _, r := range requests {
+		if r.Method != "POST" || r.Path != "/repos/example/statuses/statuses/"+b.Sha {
+			t.Errorf("Unexpected request %v %v", r.Method, r.Path)
+			continue
+		}
+		if r.Authorization != "token test-token" {
+			t.Errorf("Expected the token, got Authorization %q", r.Authorization)
+		}
+		var s GithubStatus
+		if err := json.Unmarshal(r.Body, &s); err != nil {
+			t.Error(err)
+		}
+		states = append(states, s.State)
+	}
+	// The pending status was replaced in the outbox before it was sent
+	if s := strings.Join(states, " "); s != "success" {
+		t.Errorf("Expected only success, got %v", states)
+	}
+
+	defer func(r, h, f string) {
+		*repositories, *hookURL, *hookStateFile = r, h, f
+	}(*repositories, *hookURL, *hookStateFile)
+	*repositories, *hookURL = "example/a:example/b", "https://tang.example.com/hook"
+	dir, err := ioutil.TempDir("", "tang-hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	*hookStateFile = path.Join(dir, "hooks.json")
+	configureHooks()
+
+	var posts []recordedRequest
+	for _, r := range fakeGithub.Take() {
+		if r.Method == "POST" {
+			posts = append(posts, r)
+		}
+	}
+	if len(posts) != 2 {
+		t.Fatalf("Expected 2 hooks to be created, got %v", posts)
+	}
+	for i, repo := range []string{"example/a", "example/b"} {
+		var hook GithubHook
+		json.Unmarshal(posts[i].Body, &hook)
+		if posts[i].Path != "/repos/"+repo+"/hooks" || hook.Config.Url != *hookURL {
+			t.Errorf("Unexpected hook request %v %s", posts[i].Path, posts[i].Body)
+		}
+	}
+}
+
+// A github with some hooks already, which records what is done to them
+type fakeHooks struct {
+	mu     sync.Mutex
+	hooks  map[string][]githubHookInfo
+	nextID int64
+	writes []string
+	locked string // a repository whose hooks can't be changed
+}
+
+func (f *fakeHooks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// /repos/<owner>/<name>/hooks[/<id>] or /orgs/<org>/hooks[/<id>]
+	var repo string
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if parts[0] == "orgs" {
+		repo, parts = parts[1], parts[2:]
+	} else {
+		repo, parts = parts[1]+"/"+parts[2], parts[3:]
+	}
+	var id int64
+	if len(parts) > 1 {
+		id, _ = strconv.ParseInt(parts[1], 10, 64)
+	}
+	if r.Method != "GET" {
+		f.writes = append(f.writes, r.Method+" "+r.URL.Path)
+		if repo == f.locked {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+
+	var hook GithubHook
+	json.NewDecoder(r.Body).Decode(&hook)
+	info := githubHookInfo{ID: id, Name: hook.Name, Active: hook.Active,
+		Events: hook.Events, Config: hook.Config}
+	info.Config.Secret = "" // github never tells
+
+	hooks := f.hooks[repo]
+	switch r.Method {
+	case "GET":
+		json.NewEncoder(w).Encode(hooks)
+	case "POST":
+		f.nextID++
+		info.ID = f.nextID
+		f.hooks[repo] = append(hooks, info)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(info)
+	case "PATCH", "DELETE":
+		for i, h := range hooks {
+			if h.ID != id {
+				continue
+			}
+			if r.Method == "PATCH" {
+				hooks[i] = info
+				json.NewEncoder(w).Encode(info)
+				return
+			}
+			f.hooks[repo] = append(hooks[:i], hooks[i+1:]...)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeHooks) Writes() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	writes := f.writes
+	f.writes = nil
+	return writes
+}
+
+func TestHookReconcile(t *testing.T) {
+	defer IndentLogger()()
+
+	dir, err := ioutil.TempDir("", "tang-hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hookURL0 := "https://old.example.com/hook"
+	fake := &fakeHooks{nextID: 100, hooks: map[string][]githubHookInfo{
+		// Made by tang at its old URL, before there was a state file
+		"example/moved": {{ID: 1, Active: true, Events: hookEvents,
+			Config: GithubHookConfig{Url: hookURL0, ContentType: "json"}}},
+		// Somebody else's, and two of ours
+		"example/dupes": {
+			{ID: 2, Active: true, Config: GithubHookConfig{Url: "https://ci.example.com/"}},
+			{ID: 3, Active: true, Events: hookEvents,
+				Config: GithubHookConfig{Url: "https://tang.example.com/hook", ContentType: "json"}},
+			{ID: 4, Active: false, Events: []string{"push"},
+				Config: GithubHookConfig{Url: "https://tang.example.com/hook", ContentType: "json"}},
+		},
+		"example/gone": {{ID: 5, Active: true, Events: hookEvents,
+			Config: GithubHookConfig{Url: "https://tang.example.com/hook", ContentType: "json"}}},
+		"example/locked": {{ID: 7, Active: true, Events: hookEvents,
+			Config: GithubHookConfig{Url: "https://tang.example.com/hook", ContentType: "json"}}},
+	}, locked: "example/locked"}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	defer func(api, r, h, f, secret string, prune, dry bool) {
+		*githubAPI, *repositories, *hookURL, *hookStateFile = api, r, h, f
+		github_webhook_secret, *pruneHooks, *hooksDryRun = secret, prune, dry
+	}(*githubAPI, *repositories, *hookURL, *hookStateFile,
+		github_webhook_secret, *pruneHooks, *hooksDryRun)
+
+	*githubAPI = server.URL
+	*hookURL = "https://tang.example.com/hook"
+	*hookStateFile = path.Join(dir, "hooks.json")
+	github_webhook_secret = "sekrit"
+
+	// The state tang would have had with its old URL
+	err = saveHookState(*hookStateFile, map[string]hookState{
+		"example/moved": {ID: 1, Url: hookURL0, Secret: secretFingerprint("sekrit")},
+		"example/gone":  {ID: 5, Url: *hookURL, Secret: secretFingerprint("sekrit")},
+		// Deleted by hand
+		"example/vanished": {ID: 6, Url: *hookURL, Secret: secretFingerprint("sekrit")},
+		// Which tang isn't allowed to delete any more
+		"example/locked": {ID: 7, Url: *hookURL, Secret: secretFingerprint("sekrit")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	*pruneHooks = true
+
+	// A dry run changes nothing
+	*hooksDryRun = true
+	*repositories = "example/moved:example/dupes:example/new"
+	configureHooks()
+	if writes := fake.Writes(); len(writes) != 0 {
+		t.Errorf("Dry run changed hooks: %v", writes)
+	}
+	state, err := loadHookState(*hookStateFile)
+	if err != nil || len(state) != 4 || state["example/new"].ID != 0 {
+		t.Errorf("Dry run changed the state: %v %v", state, err)
+	}
+
+	*hooksDryRun = false
+	configureHooks()
+	pruned := fake.Writes()
+	writes := strings.Join(pruned[:4], "\n")
+	// Hooks are pruned in no particular order
+	sort.Strings(pruned[4:])
+	writes += "\n" + strings.Join(pruned[4:], "\n")
+	expected := strings.Join([]string{
+		"PATCH /repos/example/moved/hooks/1",
+		"DELETE /repos/example/dupes/hooks/4",
+		"PATCH /repos/example/dupes/hooks/3",
+		"POST /repos/example/new/hooks",
+		"DELETE /repos/example/gone/hooks/5",
+		"DELETE /repos/example/locked/hooks/7",
+		"DELETE /repos/example/vanished/hooks/6",
+	}, "\n")
+	if writes != expected {
+		t.Errorf("Expected:\n%v\ngot:\n%v", expected, writes)
+	}
+	if h := fake.hooks["example/moved"][0]; h.Config.Url != *hookURL {
+		t.Errorf("Hook not moved: %+v", h)
+	}
+	if len(fake.hooks["example/dupes"]) != 2 || len(fake.hooks["example/gone"]) != 0 {
+		t.Errorf("Wrong hooks left: %+v", fake.hooks)
+	}
+
+	state, err = loadHookState(*hookStateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The hook which couldn't be deleted is remembered, to try again
+	if len(state) != 4 || state["example/new"].ID != 101 || state["example/dupes"].ID != 3 ||
+		state["example/locked"].ID != 7 {
+		t.Errorf("Unexpected state %+v", state)
+	}
+
+	// Nothing to do the second time
+	delete(state, "example/locked")
+	err = saveHookState(*hookStateFile, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configureHooks()
+	if writes := fake.Writes(); len(writes) != 0 {
+		t.Errorf("Expected no changes, got %v", writes)
+	}
+
+	// Until the secret changes
+	github_webhook_secret = "sekrit2"
+	*repositories = "example/new"
+	*pruneHooks = false
+	configureHooks()
+	writes = strings.Join(fake.Writes(), "\n")
+	if writes != "PATCH /repos/example/new/hooks/101" {
+		t.Errorf("Expected the secret to be updated, got %v", writes)
+	}
+}
+
+func TestOrganization(t *testing.T) {
+	defer IndentLogger()()
+
+	dir, err := ioutil.TempDir("", "tang-org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The organization's repositories, over two pages
+	pages := [][]githubRepo{
+		{
+			{FullName: "example/api", Name: "api", Topics: []string{"tang", "go"}},
+			{FullName: "example/www", Name: "www"},
+			{FullName: "example/old", Name: "old", Topics: []string{"tang"}, Archived: true},
+		},
+		{
+			{FullName: "example/api-archive", Name: "api-archive", Topics: []string{"tang"}},
+			{FullName: "example/secret", Name: "secret", Topics: []string{"tang", "private"}},
+			{FullName: "example/worker", Name: "worker", Topics: []string{"tang"}},
+		},
+	}
+	hooks := &fakeHooks{nextID: 100, hooks: map[string][]githubHookInfo{}}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/orgs/example/repos":
+			if r.URL.Query().Get("per_page") != "100" {
+				t.Errorf("Expected 100 per page, got %v", r.URL)
+			}
+			w.Header().Set("Link", fmt.Sprintf(`<%v/organizations/1/repos?page=2>; rel="next", `+
+				`<%v/organizations/1/repos?page=2>; rel="last"`, server.URL, server.URL))
+			json.NewEncoder(w).Encode(pages[0])
+		case "/organizations/1/repos":
+			json.NewEncoder(w).Encode(pages[1])
+		default:
+			hooks.ServeHTTP(w, r)
+		}
+	}))
+	defer server.Close()
+
+	defer func(api, org, f string, hook, prune bool, config *Config) {
+		*githubAPI, *organization, *hookStateFile = api, org, f
+		*orgHook, *pruneHooks, tangConfig = hook, prune, config
+		orgRepos.watched = nil
+	}(*githubAPI, *organization, *hookStateFile, *orgHook, *pruneHooks, tangConfig)
+
+	*githubAPI = server.URL
+	*organization = "example"
+	*hookStateFile = path.Join(dir, "hooks.json")
+	*pruneHooks = true
+	tangConfig = &Config{Organization: OrgConfig{
+		Names:  Filter{Exclude: []string{"*-archive"}},
+		Topics: Filter{Include: []string{"tang"}, Exclude: []string{"private"}},
+	}}
+
+	// Until the repositories are listed, any not excluded by name will do
+	if !watching("example/new") || watching("example/api-archive") || watching("other/api") {
+		t.Errorf("Wrong repositories watched before listing")
+	}
+
+	repos, err := watchedRepositories()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := strings.Join(repos, " "); s != "example/api example/worker" {
+		t.Errorf("Expected to watch api and worker, got %v", s)
+	}
+	if !watching("example/api") || watching("example/www") || watching("example/new") {
+		t.Errorf("Wrong repositories watched after listing")
+	}
+	err = submitBuild(&Build{BuildRecord: BuildRecord{
+		Repository: Repository{Name: "www", Organization: "example"}}})
+	if err != ErrRepoNotWatched {
+		t.Errorf("Expected www to be ignored, got %v", err)
+	}
+
+	// A hook for each repository
+	configureHooks()
+	writes := strings.Join(hooks.Writes(), " ")
+	if writes != "POST /repos/example/api/hooks POST /repos/example/worker/hooks" {
+		t.Errorf("Expected a hook on each repository, got %v", writes)
+	}
+
+	// Then one for the organization instead
+	*orgHook = true
+	configureHooks()
+	writes = strings.Join(hooks.Writes(), " ")
+	expected := []string{"POST /orgs/example/hooks",
+		"DELETE /repos/example/api/hooks/101 DELETE /repos/example/worker/hooks/102",
+		"DELETE /repos/example/worker/hooks/102 DELETE /repos/example/api/hooks/101"}
+	if writes != expected[0]+" "+expected[1] && writes != expected[0]+" "+expected[2] {
+		t.Errorf("Expected the organization hook to replace the others, got %v", writes)
+	}
+	if h := hooks.hooks["example"]; len(h) != 1 || h[0].Config.Url != *hookURL {
+		t.Errorf("Unexpected organization hooks %+v", h)
+	}
+}
+
+func TestGithubClientRetries(t *testing.T) {
+	defer IndentLogger()()
+
+	// Each request gets the next response, the last one forever after
+	var (
+		mu        sync.Mutex
+		responses []func(w http.ResponseWriter)
+		requests  int
+	)
+	respond := func(code int, header ...string) func(w http.ResponseWriter) {
+		return func(w http.ResponseWriter) {
+			for i := 0; i < len(header); i += 2 {
+				w.Header().Set(header[i], header[i+1])
+			}
+			w.WriteHeader(code)
+			fmt.Fprint(w, "{}")
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		i := requests
+		if i >= len(responses) {
+			i = len(responses) - 1
+		}
+		requests++
+		responses[i](w)
+	}))
+	defer server.Close()
+
+	defer func(api string) { *githubAPI = api }(*githubAPI)
+	*githubAPI = server.URL
+
+	var slept []time.Duration
+	c := NewGithubClient()
+	c.Retries = 3
+	c.sleep = func(d time.Duration) { slept = append(slept, d) }
+
+	method := "POST"
+	expect := func(name string, expectErr bool, expectSlept ...time.Duration) {
+		_, _, err := c.Do(method, "{}", "repos", "example/repo", "statuses", "abc")
+		if (err != nil) != expectErr {
+			t.Errorf("%v: unexpected error %v", name, err)
+		}
+		if fmt.Sprint(slept) != fmt.Sprint(expectSlept) {
+			t.Errorf("%v: expected to sleep %v, slept %v", name, expectSlept, slept)
+		}
+		mu.Lock()
+		requests, slept = 0, nil
+		mu.Unlock()
+	}
+
+	responses = []func(http.ResponseWriter){respond(502), respond(503), respond(201)}
+	expect("5xx", false, time.Second, 2*time.Second)
+
+	responses = []func(http.ResponseWriter){respond(500)}
+	expect("always 5xx", true, time.Second, 2*time.Second, 4*time.Second)
+
+	reset := fmt.Sprint(time.Now().Add(time.Minute).Unix())
+	responses = []func(http.ResponseWriter){
+		respond(403, "X-RateLimit-Remaining", "0", "X-RateLimit-Reset", reset),
+		respond(201),
+	}
+	_, _, err := c.Do("GET", "", "rate_limit")
+	if err != nil || len(slept) != 1 || slept[0] < 58*time.Second || slept[0] > time.Minute {
+		t.Errorf("Expected to wait about a minute for the rate limit, waited %v %v", slept, err)
+	}
+	mu.Lock()
+	requests, slept = 0, nil
+	mu.Unlock()
+
+	responses = []func(http.ResponseWriter){respond(403)}
+	expect("forbidden", false)
+
+	responses = []func(http.ResponseWriter){respond(429, "Retry-After", "7")}
+	expect("secondary rate limit", true, 7*time.Second, 7*time.Second, 7*time.Second)
+
+	// Github did nothing with a POST which hit the rate limit
+	responses = []func(http.ResponseWriter){
+		respond(403, "X-RateLimit-Remaining", "0", "X-RateLimit-Reset", reset),
+		respond(201),
+	}
+	_, resp, err := c.Do("POST", "{}", "repos", "example/repo", "statuses", "abc")
+	if err != nil || resp.StatusCode != 201 || len(slept) != 1 || slept[0] < 58*time.Second {
+		t.Errorf("Expected the POST to wait for the rate limit, waited %v %v", slept, err)
+	}
+	mu.Lock()
+	requests, slept = 0, nil
+	mu.Unlock()
+
+	server.Close()
+	expect("network error of a POST", true)
+
+	method = "PATCH"
+	expect("network error", true, time.Second, 2*time.Second, 4*time.Second)
+}
+
+func TestStatusOutbox(t *testing.T) {
+	defer IndentLogger()()
+
+	var (
+		mu     sync.Mutex
+		refuse = func(w http.ResponseWriter) { w.WriteHeader(http.StatusBadGateway) }
+		sent   []GithubStatus
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if refuse != nil {
+			refuse(w)
+			return
+		}
+		var s GithubStatus
+		json.NewDecoder(r.Body).Decode(&s)
+		sent = append(sent, s)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	defer func(api string) { *githubAPI = api }(*githubAPI)
+	*githubAPI = server.URL
+	defer func(c *GithubClient) { githubClient = c }(githubClient)
+	githubClient = NewGithubClient()
+	githubClient.Retries = 0
+
+	dir, err := ioutil.TempDir("", "tang-outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "statuses.json")
+
+	o, err := OpenStatusOutbox(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.Add("github", "example/repo", "abc", GithubStatus{State: "pending", Context: "tang/build"})
+	o.Add("github", "example/repo", "abc", GithubStatus{State: "success", Context: "tang/build"})
+	o.Add("github", "example/repo", "abc", GithubStatus{State: "pending", Context: "tang/deploy"})
+	if o.Len() != 2 {
+		t.Errorf("Expected statuses to be coalesced to 2, got %v", o.Len())
+	}
+
+	if o.sendAll() || o.Len() != 2 {
+		t.Errorf("Expected statuses to stay in the outbox while github is down")
+	}
+
+	// As if tang restarted
+	o, err = OpenStatusOutbox(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Len() != 2 {
+		t.Fatalf("Expected 2 statuses after reopening, got %v", o.Len())
+	}
+
+	// Statuses refused because of the rate limit are sent again later
+	for _, header := range []string{"Retry-After", "X-RateLimit-Remaining"} {
+		header := header
+		mu.Lock()
+		refuse = func(w http.ResponseWriter) {
+			w.Header().Set(header, "0")
+			w.WriteHeader(http.StatusForbidden)
+		}
+		mu.Unlock()
+		if o.sendAll() || o.Len() != 2 {
+			t.Errorf("Expected statuses to stay in the outbox when rate limited (%v)", header)
+		}
+	}
+	mu.Lock()
+	refuse = func(w http.ResponseWriter) { w.WriteHeader(http.StatusTooManyRequests) }
+	mu.Unlock()
+	if o.sendAll() || o.Len() != 2 {
+		t.Errorf("Expected statuses to stay in the outbox after a 429")
+	}
+
+	mu.Lock()
+	refuse = nil
+	mu.Unlock()
+	if !o.sendAll() || o.Len() != 0 {
+		t.Errorf("Expected the outbox to be emptied, %v left", o.Len())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sent) != 2 || sent[0].State != "success" || sent[1].State != "pending" {
+		t.Errorf("Expected the latest status for each context, got %v", sent)
+	}
+}
+
+func TestHookStatuses(t *testing.T) {
+	defer IndentLogger()()
+	defer inTempDir(t)()
+	resetGithub(t)
+
+	b := buildRepo(t, "contexts", map[string]string{
+		"tang.hook": "#!/bin/sh\n" +
+			"echo 'tang/qa pending Starting QA' >> \"$TANG_STATUS_FILE\"\n" +
+			"echo 'tang/build failure Not allowed' >> \"$TANG_STATUS_FILE\"\n" +
+			"echo 'tang/lint maybe' >> \"$TANG_STATUS_FILE\"\n" +
+			"printf 'tang/qa success https://qa.example.com/ QA is up' >> \"$TANG_STATUS_FILE\"\n",
+	})
+	if b.State != StateSuccess {
+		t.Fatalf("Expected success, got %v %v", b.State, b.Error)
+	}
+
+	var got []string
+	for _, s := range b.Statuses {
+		got = append(got, s.Context+" "+s.State)
+	}
+	expected := "tang/build pending, tang/qa pending, tang/qa success, tang/build success"
+	if strings.Join(got, ", ") != expected {
+		t.Errorf("Expected statuses %v, got %v", expected, got)
+	}
+	if url := b.Statuses[2].TargetUrl; url != "https://qa.example.com/" {
+		t.Errorf("Expected the hook's target URL, got %v", url)
+	}
+
+	sent := map[string]string{}
+	for _, r := range sentToGithub(t) {
+		var s GithubStatus
+		json.Unmarshal(r.Body, &s)
+		sent[s.Context] = s.State
+	}
+	if sent["tang/build"] != "success" || sent["tang/qa"] != "success" || len(sent) != 2 {
+		t.Errorf("Expected tang/build and tang/qa successes to be sent, got %v", sent)
+	}
+}
+
+func TestCheckRuns(t *testing.T) {
+	defer IndentLogger()()
+	defer inTempDir(t)()
+	resetGithub(t)
+
+	defer func() { *useChecks = false }()
+	*useChecks = true
+
+	hook := "#!/bin/sh\necho \"$PWD/main.go:3:5: undefined: x\"\n"
+	for i := 1; i <= 60; i++ {
+		hook += fmt.Sprintf("echo '    main_test.go:%d: wrong'\n", i)
+	}
+	hook += "echo '/usr/lib/go/src/fmt/print.go:1: not ours'\nexit 1\n"
+	b := buildRepo(t, "checks", map[string]string{"tang.hook": hook})
+	if b.State != StateFailure {
+		t.Fatalf("Expected failure, got %v %v", b.State, b.Error)
+	}
+
+	// The check run is updated in the background
+	var (
+		runs        []recordedRequest
+		annotations []checkAnnotation
+		conclusion  string
+	)
+	for start := time.Now(); len(annotations) < 61 && time.Since(start) < 5*time.Second; {
+		for _, r := range fakeGithub.Take() {
+			if !strings.Contains(r.Path, "/check-runs") {
+				continue
+			}
+			runs = append(runs, r)
+			var update struct {
+				Conclusion string `json:"conclusion"`
+				Output     struct {
+					Annotations []checkAnnotation `json:"annotations"`
+				} `json:"output"`
+			}
+			json.Unmarshal(r.Body, &update)
+			if update.Conclusion != "" {
+				conclusion = update.Conclusion
+			}
+			annotations = append(annotations, update.Output.Annotations...)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var calls []string
+	for _, r := range runs {
+		calls = append(calls, r.Method+" "+r.Path)
+	}
+	expected := []string{
+		"POST /repos/example/checks/check-runs",
+		"PATCH /repos/example/checks/check-runs/7", // in progress
+		"PATCH /repos/example/checks/check-runs/7", // completed, 50 annotations
+		"PATCH /repos/example/checks/check-runs/7", // 11 more annotations
+	}
+	if strings.Join(calls, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("Expected %v, got %v", expected, calls)
+	}
+	if conclusion != "failure" {
+		t.Errorf("Expected conclusion failure, got %q", conclusion)
+	}
+	if len(annotations) != 61 {
+		t.Fatalf("Expected 61 annotations, got %d", len(annotations))
+	}
+	first := annotations[0]
+	if first.Path != "main.go" || first.StartLine != 3 || first.StartColumn != 5 ||
+		first.Message != "undefined: x" || first.AnnotationLevel != "failure" {
+		t.Errorf("Unexpected annotation %+v", first)
+	}
+	if last := annotations[60]; last.Path != "main_test.go" || last.StartLine != 60 {
+		t.Errorf("Unexpected annotation %+v", last)
+	}
+
+	// The check run is made as soon as the build is queued
+	q := NewBuildQueue(10)
+	queued := &Build{BuildRecord: BuildRecord{Ref: "refs/heads/master", Sha: "abc",
+		Repository: Repository{Name: "checks-queued", Organization: "example"}}}
+	if err := q.Submit(queued); err != nil || queued.check == nil {
+		t.Fatalf("Expected a check run for the queued build, got %v", err)
+	}
+	queued.check.complete(queued.BuildRecord)
+	var status string
+	for start := time.Now(); status == "" && time.Since(start) < 5*time.Second; {
+		for _, r := range fakeGithub.Take() {
+			var create struct {
+				Status string `json:"status"`
+			}
+			json.Unmarshal(r.Body, &create)
+			if r.Method == "POST" && r.Path == "/repos/example/checks-queued/check-runs" {
+				status = create.Status
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status != "queued" {
+		t.Errorf("Expected the check run to be created queued, got %q", status)
+	}
+
+	// Commits without a hook are skipped
+	b = buildRepo(t, "checks-no-hook", map[string]string{"README": "nothing to see\n"})
+	calls, conclusion = nil, ""
+	for start := time.Now(); conclusion == "" && time.Since(start) < 5*time.Second; {
+		for _, r := range fakeGithub.Take() {
+			if !strings.HasPrefix(r.Path, "/repos/example/checks-no-hook/check-runs") {
+				continue
+			}
+			calls = append(calls, r.Method+" "+r.Path)
+			var update struct {
+				Conclusion string `json:"conclusion"`
+			}
+			json.Unmarshal(r.Body, &update)
+			conclusion = update.Conclusion
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	expected = []string{
+		"POST /repos/example/checks-no-hook/check-runs",
+		"PATCH /repos/example/checks-no-hook/check-runs/7",
+	}
+	if strings.Join(calls, ", ") != strings.Join(expected, ", ") || conclusion != "skipped" {
+		t.Errorf("Expected a skipped check run, got %v %q", calls, conclusion)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+// Watching every repository of a github organization, rather than the ones
+// listed in -repositories
+// http://developer.github.com/v3/repos/#list-organization-repositories
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// The organization's repositories which are watched, found by
+// watchedRepositories(). Nil until they have been listed.
+var orgRepos struct {
+	sync.Mutex
+	watched map[string]bool
+}
+
+// A repository as github lists it
+type githubRepo struct {
+	FullName string   `json:"full_name"` // e.g "scraperwiki/tang"
+	Name     string   `json:"name"`
+	Archived bool     `json:"archived"`
+	Disabled bool     `json:"disabled"`
+	Topics   []string `json:"topics"`
+}
+
+// The repositories to watch: those of -organization chosen by the config,
+// or -repositories. Archived repositories can't be built, so are left out.
+func watchedRepositories() (repos []string, err error) {
+	if *organization == "" {
+		if *repositories == "" {
+			return nil, nil
+		}
+		return strings.Split(*repositories, ":"), nil
+	}
+
+	all, err := listOrgRepos(*organization)
+	if err != nil {
+		return
+	}
+	watched := map[string]bool{}
+	for _, r := range all {
+		if r.Archived || r.Disabled || !tangConfig.Organization.Selects(r) {
+			continue
+		}
+		repos = append(repos, r.FullName)
+		watched[r.FullName] = true
+	}
+	log.Printf("Watching %d of the %d repositories of %v", len(repos), len(all),
+		*organization)
+
+	orgRepos.Lock()
+	orgRepos.watched = watched
+	orgRepos.Unlock()
+	return
+}
+
+// Whether events from `repo` should be acted on. Without -organization,
+// that is up to whoever set up the hooks. Until the organization's
+// repositories have been listed, repositories are only chosen by name.
+func watching(repo string) bool {
+	if *organization == "" {
+		return true
+	}
+	orgRepos.Lock()
+	defer orgRepos.Unlock()
+	if orgRepos.watched != nil {
+		return orgRepos.watched[repo]
+	}
+	parts := strings.SplitN(repo, "/", 2)
+	return len(parts) == 2 && parts[0] == *organization &&
+		tangConfig.Organization.Names.Match(parts[1])
+}
+
+// Whether the repository `r` should be watched.
+func (oc OrgConfig) Selects(r githubRepo) bool {
+	if !oc.Names.Match(r.Name) {
+		return false
+	}
+	included := len(oc.Topics.Include) == 0
+	for _, topic := range r.Topics {
+		for _, pattern := range oc.Topics.Exclude {
+			if globMatch(pattern, topic) {
+				return false
+			}
+		}
+		for _, pattern := range oc.Topics.Include {
+			if globMatch(pattern, topic) {
+				included = true
+			}
+		}
+	}
+	return included
+}
+
+// All of the repositories of `org`, following the pages github splits them
+// into.
+func listOrgRepos(org string) (repos []githubRepo, err error) {
+	url := Endpoint("orgs", org, "repos?type=all&per_page=100")
+	for url != "" {
+		var (
+			response string
+			resp     *http.Response
+		)
+		response, resp, err = githubClient.DoURL("GET", url, "", org)
+		if err != nil {
+			return
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("Listing repositories of %v: %v %v", org,
+				resp.Status, response)
+		}
+
+		var page []githubRepo
+		err = json.Unmarshal([]byte(response), &page)
+		if err != nil {
+			return
+		}
+		repos = append(repos, page...)
+		url = nextPage(resp.Header.Get("Link"))
+	}
+	return
+}
+
+// <https://api.github.com/organizations/1/repos?page=2>; rel="next", ...
+var linkNext = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// The URL of the next page of results, from a Link header, if there is one.
+// http://developer.github.com/v3/#pagination
+func nextPage(link string) string {
+	m := linkNext.FindStringSubmatch(link)
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
@@ -0,0 +1,194 @@
+package main
+
+// Statuses waiting to be sent to github, kept on disk so that they survive
+// github being down and tang restarting
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Set up in main()
+var statusOutbox *StatusOutbox
+
+// How long to wait before trying again to send statuses which failed
+const outboxRetry = time.Minute
+
+// Only the latest status for each repository, sha and context is kept, since
+// that is all github would show anyway. The whole outbox is rewritten to the
+// file whenever it changes, it is never big.
+type StatusOutbox struct {
+	mu       sync.Mutex
+	filename string
+	pending  map[string]*outboxEntry
+	wake     chan struct{}
+}
+
+type outboxEntry struct {
+	Provider string       `json:"provider,omitempty"` // see providerNamed()
+	Repo     string       `json:"repo"`
+	Sha      string       `json:"sha"`
+	Status   GithubStatus `json:"status"`
+	Queued   time.Time    `json:"queued"`
+	Attempts int          `json:"attempts"`
+}
+
+func (e *outboxEntry) key() string {
+	return e.Provider + " " + e.Repo + " " + e.Sha + " " + e.Status.Context
+}
+
+// Open (or create) the outbox in `filename`, loading the statuses which
+// hadn't been sent when tang last exited.
+func OpenStatusOutbox(filename string) (o *StatusOutbox, err error) {
+	o = &StatusOutbox{
+		filename: filename,
+		pending:  map[string]*outboxEntry{},
+		wake:     make(chan struct{}, 1),
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return o, nil
+	}
+	if err != nil {
+		return
+	}
+	var entries []*outboxEntry
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		o.pending[e.key()] = e
+	}
+	log.Printf("Loaded %d unsent statuses from %v", len(entries), filename)
+	return
+}
+
+// Queue a status to be sent to `provider` (e.g "github"), replacing any
+// older one for the same commit and context which hasn't been sent yet.
+func (o *StatusOutbox) Add(provider, repo, sha string, s GithubStatus) {
+	e := &outboxEntry{Provider: provider, Repo: repo, Sha: sha, Status: s,
+		Queued: time.Now()}
+
+	o.mu.Lock()
+	o.pending[e.key()] = e
+	o.save()
+	o.mu.Unlock()
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Number of statuses waiting to be sent.
+func (o *StatusOutbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.pending)
+}
+
+// Must be called with o.mu held.
+func (o *StatusOutbox) save() {
+	entries := []*outboxEntry{}
+	for _, e := range o.pending {
+		entries = append(entries, e)
+	}
+	sort.Sort(byQueuedEntry(entries))
+
+	data, err := json.Marshal(entries)
+	if err == nil {
+		tmp := o.filename + ".tmp"
+		err = ioutil.WriteFile(tmp, data, 0666)
+		if err == nil {
+			err = os.Rename(tmp, o.filename)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to save status outbox: %v", err)
+	}
+}
+
+type byQueuedEntry []*outboxEntry
+
+func (e byQueuedEntry) Len() int           { return len(e) }
+func (e byQueuedEntry) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e byQueuedEntry) Less(i, j int) bool { return e[i].Queued.Before(e[j].Queued) }
+
+// Send statuses as they arrive, retrying those which fail. Never returns.
+func (o *StatusOutbox) Run() {
+	for {
+		var retry <-chan time.Time
+		if !o.sendAll() {
+			retry = time.After(outboxRetry)
+		}
+		select {
+		case <-o.wake:
+		case <-retry:
+		}
+	}
+}
+
+// Try to send everything in the outbox, oldest first. Returns true if the
+// outbox was emptied.
+func (o *StatusOutbox) sendAll() bool {
+	o.mu.Lock()
+	var entries []*outboxEntry
+	for _, e := range o.pending {
+		entries = append(entries, e)
+	}
+	o.mu.Unlock()
+	sort.Sort(byQueuedEntry(entries))
+
+	for _, e := range entries {
+		done := providerNamed(e.Provider).SendStatus(e.Repo, e.Sha, e.Status)
+
+		o.mu.Lock()
+		// Unless a newer status replaced it while it was being sent
+		if o.pending[e.key()] == e {
+			if done {
+				delete(o.pending, e.key())
+			} else {
+				e.Attempts++
+			}
+			o.save()
+		}
+		o.mu.Unlock()
+	}
+	return o.Len() == 0
+}
+
+// Send a status to github. Returns false if it is worth trying again later.
+// curl -H "Authorization: token $GITHUB_TOKEN" -d '{"state": "success", "target_url": "https://deleteme.pwaller.qa.scraperwiki.com/", "description": "Tests pass, deleteme.pwaller.qa.scraperwiki.com up"}' https://api.github.com/repos/scraperwiki/custard/statuses/c8e3e81f13ce73de42364fd61aae1216b5dc2b69
+func sendStatus(repo, sha string, githubStatus GithubStatus) bool {
+	bytes, err := json.Marshal(githubStatus)
+	check(err)
+	response, resp, err := Github(string(bytes), "repos", repo, "statuses", sha)
+	switch {
+	case err == ErrSkipGithubEndpoint:
+	case err != nil:
+		// github is down, or we are rate limited for a long time
+		log.Printf("Failed to update status of %v %v: %v", repo, sha, err)
+		return false
+	case rateLimited(resp):
+		log.Printf("Failed to update status of %v %v: %v", repo, sha, resp.Status)
+		return false
+	case resp.StatusCode != http.StatusCreated:
+		// Trying again won't help, e.g, the sha doesn't exist.
+		log.Printf("Failed to update status of %v %v, giving up: %v %v", repo, sha,
+			resp.Status, response)
+	}
+	return true
+}
+
+// Queue a status to be sent to github, or another provider, see StatusOutbox.
+func updateStatus(provider, repo, sha string, s GithubStatus) {
+	statusOutbox.Add(provider, repo, sha, s)
+}
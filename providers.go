@@ -0,0 +1,173 @@
+package main
+
+// Hosts other than github which can send tang webhooks, and which tang
+// reports statuses back to
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMissingToken          = errors.New("Missing webhook token or signature")
+	ErrProviderNotConfigured = errors.New("Provider's webhook secret or credentials not set")
+)
+
+// Where webhooks come from, and statuses go back to. Events are normalised
+// into a PushEvent for eventPush, or a pull request build for
+// submitPullRequest, so the rest of tang needn't know which provider a
+// repository is on (but see Repository.Provider).
+type Provider interface {
+	// e.g "gitlab", recorded in Repository.Provider
+	Name() string
+
+	// Whether a request with `header` was sent by this provider. Providers
+	// other than github are only detected once their webhook secret and
+	// credentials are set, so that nobody can pretend to be one to get
+	// around github's signature.
+	Detect(header http.Header) bool
+
+	// The type of event in a request with `header`, e.g "push"
+	EventType(header http.Header) string
+
+	// Check the request was sent by someone who knows the webhook secret.
+	// Only github's is optional.
+	Verify(header http.Header, body []byte) error
+
+	// Act on an event, queueing builds.
+	Handle(eventType string, document []byte) error
+
+	// Send a status to the provider. Returns false if it is worth trying
+	// again later, see StatusOutbox.
+	SendStatus(repo, sha string, s GithubStatus) bool
+
+	// The username and password git should use for `repo`.
+	Credentials(repo string) (username, password string, err error)
+}
+
+// In the order they are detected in, since gitea sends X-GitHub-Event too.
+var providers = []Provider{
+	giteaProvider{},
+	gitlabProvider{},
+	bitbucketProvider{},
+	githubProvider{},
+}
+
+// The provider which sent a request with `header`, nil if there isn't one.
+func detectProvider(header http.Header) Provider {
+	for _, p := range providers {
+		if p.Detect(header) {
+			return p
+		}
+	}
+	return nil
+}
+
+// The provider called `name`. Repositories which don't say are on github.
+func providerNamed(name string) Provider {
+	for _, p := range providers {
+		if p.Name() == name {
+			return p
+		}
+	}
+	return githubProvider{}
+}
+
+// Github, which tang was written for. Most of it is elsewhere.
+type githubProvider struct{}
+
+func (githubProvider) Name() string { return "github" }
+
+func (githubProvider) Detect(header http.Header) bool {
+	return len(header["X-Github-Event"]) == 1
+}
+
+func (githubProvider) EventType(header http.Header) string {
+	return header.Get("X-Github-Event")
+}
+
+func (githubProvider) Verify(header http.Header, body []byte) error {
+	if github_webhook_secret == "" {
+		return nil
+	}
+	return checkSignature(header, body, github_webhook_secret)
+}
+
+func (githubProvider) Handle(eventType string, document []byte) error {
+	return handleEvent(eventType, document)
+}
+
+func (githubProvider) SendStatus(repo, sha string, s GithubStatus) bool {
+	return sendStatus(repo, sha, s)
+}
+
+func (githubProvider) Credentials(repo string) (username, password string, err error) {
+	return githubCredentials(repo)
+}
+
+// Requests to providers other than github, which are retried by the outbox
+// rather than here.
+var providerHTTP = &http.Client{Timeout: 30 * time.Second}
+
+// Send `payload` as JSON to `url`, as a status of `repo` `sha`. `auth` adds
+// the provider's credentials to the request. Returns false if it is worth
+// trying again later.
+func postStatus(provider, repo, sha, url string, payload interface{}, auth func(*http.Request)) bool {
+	body, err := json.Marshal(payload)
+	check(err)
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	check(err)
+	req.Header.Set("Content-Type", "application/json")
+	auth(req)
+
+	log.Println("Querying POST", url)
+	resp, err := providerHTTP.Do(req)
+	if err != nil {
+		log.Printf("Failed to update %v status of %v %v: %v", provider, repo, sha, err)
+		return false
+	}
+	defer resp.Body.Close()
+	response, _ := ioutil.ReadAll(resp.Body)
+
+	switch {
+	case resp.StatusCode >= 500:
+		log.Printf("Failed to update %v status of %v %v: %v", provider, repo, sha,
+			resp.Status)
+		return false
+	case resp.StatusCode/100 != 2:
+		// Trying again won't help, e.g, the sha doesn't exist.
+		log.Printf("Failed to update %v status of %v %v, giving up: %v %s", provider,
+			repo, sha, resp.Status, response)
+	}
+	return true
+}
+
+// The URL of `endpoint` under a provider's `api` base URL.
+func providerEndpoint(api string, endpoint ...string) string {
+	return strings.TrimSuffix(api, "/") + "/" + strings.Join(endpoint, "/")
+}
+
+// Split e.g "group/subgroup/project" into its namespace and name.
+func splitRepoName(fullName string) (organization, name string) {
+	i := strings.LastIndex(fullName, "/")
+	if i < 0 {
+		return "", fullName
+	}
+	return fullName[:i], fullName[i+1:]
+}
+
+// The commits of a push for PushEvent.ChangedFiles, none if the provider
+// left some out of the payload (the changed files are then found with git,
+// see Build.touchesPaths).
+func pushCommits(commits []Commit, total int) []Commit {
+	if total > len(commits) {
+		return nil
+	}
+	return commits
+}
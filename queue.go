@@ -0,0 +1,247 @@
+package main
+
+// A bounded queue of builds, run by a fixed number of workers
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+var ErrQueueFull = errors.New("Build queue is full")
+
+// Returned by the run function of a build whose concurrency group is busy,
+// which puts it back in the queue, see joinGroup.
+var ErrGroupBusy = errors.New("Concurrency group is busy")
+
+// Set up in main()
+var buildQueue *BuildQueue
+
+// Builds are taken from the queue in the order they arrive, except that only
+// one build per repository runs at a time, since they share a git mirror,
+// and one build per concurrency group.
+type BuildQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []*Build
+	running map[string]*Build // keyed by repository
+	groups  map[string]*Build // keyed by concurrency group
+	size    int
+
+	// What the workers do with a build
+	run func(*Build) error
+}
+
+func NewBuildQueue(size int) *BuildQueue {
+	q := &BuildQueue{
+		running: map[string]*Build{},
+		groups:  map[string]*Build{},
+		size:    size,
+		run:     runBuild,
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// Start `workers` goroutines which take builds from the queue.
+func (q *BuildQueue) Start(workers int) {
+	for i := 0; i < workers; i++ {
+		go q.worker()
+	}
+}
+
+// Add a build to the back of the queue. Fails with ErrQueueFull if there are
+// already `size` builds waiting, after dropping those `b` supersedes.
+func (q *BuildQueue) Submit(b *Build) error {
+	superseded, err := q.add(b)
+	// Finishing a build reports it to github, which mustn't hold up the queue
+	for _, s := range superseded {
+		s.finish(s.err)
+		close(s.done)
+	}
+	return err
+}
+
+// The part of Submit done with q.mu held. Returns the builds `b` supersedes.
+func (q *BuildQueue) add(b *Build) (superseded []*Build, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if *tangConfig.Repo(b.RepoName()).Supersede {
+		superseded = q.supersede(b)
+	}
+
+	if len(q.pending) >= q.size {
+		return superseded, ErrQueueFull
+	}
+
+	if b.ID == "" {
+		b.ID = newBuildID()
+	}
+	b.queue = q
+	b.Queued = time.Now()
+	b.State = StateQueued
+	b.done = make(chan struct{})
+	b.cancel = make(chan struct{})
+	b.save()
+	// Github shows the build as queued until it starts. Builds of a tag
+	// which hasn't been resolved yet get their check run once it is.
+	if *useChecks && b.Repository.Provider == "" && b.Sha != "" {
+		b.check = newCheckRun(b.RepoName())
+		b.check.create(b.Sha)
+	}
+	q.pending = append(q.pending, b)
+	log.Printf("Queued %v %v (%d waiting, %d running)", b.RepoName(), b.Sha,
+		len(q.pending), len(q.running))
+
+	q.cond.Broadcast()
+	return
+}
+
+// Drop waiting builds and cancel the running build which are for the same
+// ref as `newer` but a different commit. Returns the dropped builds, which
+// the caller must finish. Must be called with q.mu held.
+func (q *BuildQueue) supersede(newer *Build) (dropped []*Build) {
+	pending := q.pending[:0]
+	for _, b := range q.pending {
+		if !b.SupersededBy(newer) {
+			pending = append(pending, b)
+			continue
+		}
+		log.Printf("Dropping queued %v %v %v, superseded by %v",
+			b.RepoName(), b.Ref, b.Sha, newer.Sha)
+		b.supersededBy = newer.Sha
+		b.err = ErrSuperseded
+		dropped = append(dropped, b)
+	}
+	q.pending = pending
+
+	if b, ok := q.running[newer.RepoName()]; ok && b.SupersededBy(newer) {
+		log.Printf("Cancelling running %v %v %v, superseded by %v",
+			b.RepoName(), b.Ref, b.Sha, newer.Sha)
+		b.Cancel(newer.Sha)
+	}
+	return
+}
+
+// Number of builds waiting to run.
+func (q *BuildQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// The builds which are currently running and those waiting, in queue order.
+func (q *BuildQueue) Snapshot() (running, pending []*Build) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, b := range q.running {
+		running = append(running, b)
+	}
+	pending = append(pending, q.pending...)
+	return
+}
+
+// The build with ID `id`, if it is running or waiting to run.
+func (q *BuildQueue) Lookup(id string) *Build {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, b := range q.running {
+		if b.ID == id {
+			return b
+		}
+	}
+	for _, b := range q.pending {
+		if b.ID == id {
+			return b
+		}
+	}
+	return nil
+}
+
+// Remove and return the first pending build whose repository and
+// concurrency group are not busy. Must be called with q.mu held.
+func (q *BuildQueue) next() *Build {
+	for i, b := range q.pending {
+		if _, busy := q.running[b.RepoName()]; busy {
+			continue
+		}
+		if _, busy := q.groups[b.group]; busy && b.group != "" {
+			continue
+		}
+		q.pending = append(q.pending[:i], q.pending[i+1:]...)
+		return b
+	}
+	return nil
+}
+
+func (q *BuildQueue) worker() {
+	for {
+		q.mu.Lock()
+		b := q.next()
+		for b == nil {
+			q.cond.Wait()
+			b = q.next()
+		}
+		q.running[b.RepoName()] = b
+		if b.group != "" {
+			q.groups[b.group] = b
+		}
+		b.Started = time.Now()
+		b.State = StateRunning
+		b.save()
+		q.mu.Unlock()
+
+		err := q.run(b)
+		if err == ErrGroupBusy {
+			q.requeue(b)
+			continue
+		}
+		b.err = err
+		if b.err != nil {
+			log.Printf("Error building %v %v: %q", b.RepoName(), b.Sha, b.err)
+		}
+		b.finish(b.err)
+		close(b.done)
+
+		q.mu.Lock()
+		delete(q.running, b.RepoName())
+		if q.groups[b.group] == b {
+			delete(q.groups, b.group)
+		}
+		q.cond.Broadcast()
+		q.mu.Unlock()
+	}
+}
+
+// Put `b`, which is waiting for its concurrency group, back at the front of
+// the queue, so that the worker can get on with other builds.
+func (q *BuildQueue) requeue(b *Build) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	log.Printf("Requeued %v %v, waiting for concurrency group %v", b.RepoName(),
+		b.Sha, b.group)
+	delete(q.running, b.RepoName())
+	b.State = StateQueued
+	b.save()
+	q.pending = append([]*Build{b}, q.pending...)
+	q.cond.Broadcast()
+}
+
+// Put running build `b` in the concurrency group `name`, which only one
+// build runs in at a time, whichever repository it is of. Returns false if
+// another build holds the group, in which case the build should return
+// ErrGroupBusy, and is run again once the group is free.
+func (q *BuildQueue) joinGroup(b *Build, name string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	b.group = name
+	if holder, busy := q.groups[b.group]; busy && holder != b {
+		return false
+	}
+	q.groups[b.group] = b
+	return true
+}
@@ -0,0 +1,201 @@
+package main
+
+// tang.yml, a repository's optional description of how tang should build it
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const RepoFileName = "tang.yml"
+
+// Example:
+//
+//	hook: make test          # run with sh -c, instead of ./tang.hook
+//	timeout: 20m
+//	branches:
+//	  include: [master, "release-*"]
+//	  exclude: ["wip-*"]
+//	tags:
+//	  include: ["v*"]
+//	paths:                   # only build if a matching file changed
+//	  include: ["services/api/**", go.mod]
+//	env:
+//	  GOFLAGS: -v
+//	context: ci/tang         # name of the github status, tang/build by default
+//	concurrency: deploy      # builds in the same group run one at a time,
+//	                         # even across repositories
+//	pull_requests: false     # don't build pull requests
+type RepoFile struct {
+	Hook         string            `yaml:"hook"`
+	Timeout      string            `yaml:"timeout"`
+	Branches     Filter            `yaml:"branches"`
+	Tags         Filter            `yaml:"tags"`
+	Paths        Filter            `yaml:"paths"`
+	Env          map[string]string `yaml:"env"`
+	Context      string            `yaml:"context"`
+	Concurrency  string            `yaml:"concurrency"`
+	PullRequests *bool             `yaml:"pull_requests"`
+
+	timeout time.Duration
+}
+
+// Glob patterns, see path.Match. A name matches if it matches one of
+// Include (or Include is empty) and none of Exclude. A pattern ending in
+// "/**" matches everything below the directories matching the rest of it.
+type Filter struct {
+	Include []string `yaml:"include" json:"include,omitempty"`
+	Exclude []string `yaml:"exclude" json:"exclude,omitempty"`
+}
+
+func (f Filter) Match(name string) bool {
+	included := len(f.Include) == 0
+	for _, pattern := range f.Include {
+		if globMatch(pattern, name) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+	for _, pattern := range f.Exclude {
+		if globMatch(pattern, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// True if there are no patterns, so that everything matches.
+func (f Filter) Empty() bool {
+	return len(f.Include) == 0 && len(f.Exclude) == 0
+}
+
+// True if any of `names` match.
+func (f Filter) MatchAny(names []string) bool {
+	for _, name := range names {
+		if f.Match(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f Filter) Validate() error {
+	for _, pattern := range append(f.Include, f.Exclude...) {
+		pattern = strings.TrimSuffix(pattern, "/**")
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// path.Match, plus "dir/**" matching anything below dir.
+func globMatch(pattern, name string) bool {
+	if !strings.HasSuffix(pattern, "/**") {
+		ok, _ := path.Match(pattern, name)
+		return ok
+	}
+	dir := strings.TrimSuffix(pattern, "/**")
+	parts := strings.Split(name, "/")
+	depth := strings.Count(dir, "/") + 1
+	if len(parts) <= depth {
+		return false
+	}
+	ok, _ := path.Match(dir, strings.Join(parts[:depth], "/"))
+	return ok
+}
+
+// Whether `ref` passes the filters: branches are matched by their name
+// against `branches`, tags against `tags`. Other refs (e.g, pull requests)
+// always pass.
+func refIncluded(ref string, branches, tags Filter) bool {
+	switch {
+	case strings.HasPrefix(ref, "refs/heads/"):
+		return branches.Match(strings.TrimPrefix(ref, "refs/heads/"))
+	case strings.HasPrefix(ref, "refs/tags/"):
+		return tags.Match(strings.TrimPrefix(ref, "refs/tags/"))
+	}
+	return true
+}
+
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Parse and validate a tang.yml.
+func ParseRepoFile(data []byte) (rf *RepoFile, err error) {
+	rf = &RepoFile{}
+	err = yaml.UnmarshalStrict(data, rf)
+	if err != nil {
+		return nil, err
+	}
+	err = rf.validate()
+	if err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RepoFile) validate() (err error) {
+	if rf.Timeout != "" {
+		rf.timeout, err = time.ParseDuration(rf.Timeout)
+		if err != nil || rf.timeout <= 0 {
+			return fmt.Errorf("timeout: bad duration %q", rf.Timeout)
+		}
+	}
+	if err = rf.Branches.Validate(); err != nil {
+		return fmt.Errorf("branches: %v", err)
+	}
+	if err = rf.Tags.Validate(); err != nil {
+		return fmt.Errorf("tags: %v", err)
+	}
+	if err = rf.Paths.Validate(); err != nil {
+		return fmt.Errorf("paths: %v", err)
+	}
+	for name := range rf.Env {
+		if !envName.MatchString(name) {
+			return fmt.Errorf("env: bad variable name %q", name)
+		}
+		if strings.HasPrefix(name, "TANG_") {
+			return fmt.Errorf("env: %v, TANG_ variables are reserved", name)
+		}
+	}
+	if len(rf.Context) > maxStatusContext {
+		return fmt.Errorf("context: longer than %d characters", maxStatusContext)
+	}
+	return nil
+}
+
+// Whether pull requests should be built, they are unless told otherwise.
+func (rf *RepoFile) BuildPullRequests() bool {
+	return rf.PullRequests == nil || *rf.PullRequests
+}
+
+// The environment variables in NAME=value form, sorted by name.
+func (rf *RepoFile) Environ() (env []string) {
+	for name, value := range rf.Env {
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+	return
+}
+
+// Read the tang.yml at `ref` in `git_dir`. Returns nil if there isn't one.
+func readRepoFile(git_dir, ref string) (rf *RepoFile, err error) {
+	data, ok, err := gitShowFile(git_dir, ref, RepoFileName)
+	if err != nil || !ok {
+		return
+	}
+	rf, err = ParseRepoFile(data)
+	if err != nil {
+		err = fmt.Errorf("%v: %v", RepoFileName, err)
+	}
+	return
+}
@@ -0,0 +1,158 @@
+package main
+
+// A record of every build, kept on disk so that it survives restarts
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Set up in main()
+var buildStore *BuildStore
+
+// Builds are appended to the file as a line of JSON every time they change,
+// so the last line for a given ID wins. The file is compacted when opened.
+type BuildStore struct {
+	mu     sync.Mutex
+	fd     *os.File
+	builds map[string]BuildRecord
+
+	// The builds which were marked interrupted when the store was opened,
+	// see reportInterrupted.
+	interrupted []string
+}
+
+// Open (or create) the store in `filename`, loading the builds it contains.
+// Builds which were in progress when tang last exited are marked
+// interrupted.
+func OpenBuildStore(filename string) (s *BuildStore, err error) {
+	s = &BuildStore{builds: map[string]BuildRecord{}}
+
+	err = s.load(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+
+	for id, r := range s.builds {
+		if r.State == StateQueued || r.State == StateRunning {
+			r.State = StateInterrupted
+			s.builds[id] = r
+			s.interrupted = append(s.interrupted, id)
+		}
+	}
+
+	// Rewrite the file with one line per build
+	tmp := filename + ".tmp"
+	s.fd, err = os.Create(tmp)
+	if err != nil {
+		return
+	}
+	for _, r := range s.builds {
+		err = s.write(r)
+		if err != nil {
+			return
+		}
+	}
+	err = os.Rename(tmp, filename)
+	if err != nil {
+		return
+	}
+
+	log.Printf("Loaded %d builds from %v", len(s.builds), filename)
+	return
+}
+
+func (s *BuildStore) load(filename string) (err error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+	scanner.Buffer(nil, 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var r BuildRecord
+		err = json.Unmarshal(scanner.Bytes(), &r)
+		if err != nil {
+			// Most likely a partial write when we were killed.
+			log.Printf("Skipping %v:%d: %v", filename, line, err)
+			continue
+		}
+		s.builds[r.ID] = r
+	}
+	return scanner.Err()
+}
+
+// Must be called with s.mu held (or before the store is shared).
+func (s *BuildStore) write(r BuildRecord) (err error) {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	_, err = s.fd.Write(append(line, '\n'))
+	return
+}
+
+// Record the current state of a build.
+func (s *BuildStore) Save(r BuildRecord) (err error) {
+	if r.ID == "" {
+		return fmt.Errorf("BuildStore.Save: build has no ID")
+	}
+	// Don't share the slice with the build, which carries on appending.
+	r.Statuses = append([]GithubStatus(nil), r.Statuses...)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.builds[r.ID] = r
+	return s.write(r)
+}
+
+func (s *BuildStore) Get(id string) (r BuildRecord, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok = s.builds[id]
+	return
+}
+
+// All of the builds, most recently queued first.
+func (s *BuildStore) List() []BuildRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	builds := make([]BuildRecord, 0, len(s.builds))
+	for _, r := range s.builds {
+		builds = append(builds, r)
+	}
+	sort.Sort(byQueued(builds))
+	return builds
+}
+
+type byQueued []BuildRecord
+
+func (b byQueued) Len() int      { return len(b) }
+func (b byQueued) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byQueued) Less(i, j int) bool {
+	if !b[i].Queued.Equal(b[j].Queued) {
+		return b[i].Queued.After(b[j].Queued)
+	}
+	return b[i].ID > b[j].ID
+}
+
+// How long the build took, or has taken so far.
+func (r BuildRecord) Duration() time.Duration {
+	switch {
+	case r.Started.IsZero():
+		return 0
+	case r.Finished.IsZero():
+		return time.Since(r.Started)
+	}
+	return r.Finished.Sub(r.Started)
+}
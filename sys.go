@@ -9,7 +9,9 @@ import (
 	"os/exec"
 	"reflect"
 	"runtime"
+	"sync"
 	"syscall"
+	"time"
 	"unsafe"
 )
 
@@ -98,3 +100,63 @@ func Command(workdir, command string, args ...string) *exec.Cmd {
 	cmd.Stderr = os.Stderr
 	return cmd
 }
+
+// Send `sig` to every process in the process group led by `cmd`, which must
+// have been started with Setpgid.
+func killProcessGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+	return syscall.Kill(-cmd.Process.Pid, sig)
+}
+
+// The process groups of the hooks which are running. Each hook has a group
+// of its own, which the sentinel's kill of tang's group doesn't reach, so
+// they are stopped by stopHooks when tang exits.
+var runningHooks = struct {
+	sync.Mutex
+	pgids map[int]bool
+}{pgids: map[int]bool{}}
+
+// Keep track of hook `cmd`, which has started. Call hookExited once it has
+// been waited for.
+func hookStarted(cmd *exec.Cmd) {
+	runningHooks.Lock()
+	defer runningHooks.Unlock()
+	runningHooks.pgids[cmd.Process.Pid] = true
+}
+
+func hookExited(cmd *exec.Cmd) {
+	runningHooks.Lock()
+	defer runningHooks.Unlock()
+	delete(runningHooks.pgids, cmd.Process.Pid)
+}
+
+// Send `sig` to every running hook, returning how many there are.
+func signalHooks(sig syscall.Signal) int {
+	runningHooks.Lock()
+	defer runningHooks.Unlock()
+	for pgid := range runningHooks.pgids {
+		err := syscall.Kill(-pgid, sig)
+		if err != nil {
+			log.Printf("Failed to send %v to hook %v: %v", sig, pgid, err)
+		}
+	}
+	return len(runningHooks.pgids)
+}
+
+// Stop every running hook and everything they started, as tang is exiting.
+// Hooks still running -kill-grace after SIGTERM get SIGKILL.
+func stopHooks() {
+	if signalHooks(syscall.SIGTERM) == 0 {
+		return
+	}
+	log.Println("Waiting for hooks to stop..")
+	for deadline := time.Now().Add(*killGrace); time.Now().Before(deadline); {
+		time.Sleep(100 * time.Millisecond)
+		runningHooks.Lock()
+		running := len(runningHooks.pgids)
+		runningHooks.Unlock()
+		if running == 0 {
+			return
+		}
+	}
+	signalHooks(syscall.SIGKILL)
+}